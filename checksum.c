@@ -0,0 +1,276 @@
+#include <stdio.h>
+#include <string.h>
+#include <strings.h>
+
+#include "checksum.h"
+
+#define ROTL(x, n) (((x) << (n)) | ((x) >> (32 - (n))))
+#define ROTR(x, n) (((x) >> (n)) | ((x) << (32 - (n))))
+
+static const char* const checksumNames[CHECKSUM_COUNT] = {
+    "md5",
+    "sha1",
+    "sha256",
+};
+
+static const size_t checksumDigestLengths[CHECKSUM_COUNT] = {
+    16,
+    20,
+    32,
+};
+
+static const uint32_t md5Shifts[64] = {
+    7, 12, 17, 22, 7, 12, 17, 22, 7, 12, 17, 22, 7, 12, 17, 22,
+    5,  9, 14, 20, 5,  9, 14, 20, 5,  9, 14, 20, 5,  9, 14, 20,
+    4, 11, 16, 23, 4, 11, 16, 23, 4, 11, 16, 23, 4, 11, 16, 23,
+    6, 10, 15, 21, 6, 10, 15, 21, 6, 10, 15, 21, 6, 10, 15, 21,
+};
+
+static const uint32_t md5Constants[64] = {
+    0xd76aa478, 0xe8c7b756, 0x242070db, 0xc1bdceee, 0xf57c0faf, 0x4787c62a, 0xa8304613, 0xfd469501,
+    0x698098d8, 0x8b44f7af, 0xffff5bb1, 0x895cd7be, 0x6b901122, 0xfd987193, 0xa679438e, 0x49b40821,
+    0xf61e2562, 0xc040b340, 0x265e5a51, 0xe9b6c7aa, 0xd62f105d, 0x02441453, 0xd8a1e681, 0xe7d3fbc8,
+    0x21e1cde6, 0xc33707d6, 0xf4d50d87, 0x455a14ed, 0xa9e3e905, 0xfcefa3f8, 0x676f02d9, 0x8d2a4c8a,
+    0xfffa3942, 0x8771f681, 0x6d9d6122, 0xfde5380c, 0xa4beea44, 0x4bdecfa9, 0xf6bb4b60, 0xbebfbc70,
+    0x289b7ec6, 0xeaa127fa, 0xd4ef3085, 0x04881d05, 0xd9d4d039, 0xe6db99e5, 0x1fa27cf8, 0xc4ac5665,
+    0xf4292244, 0x432aff97, 0xab9423a7, 0xfc93a039, 0x655b59c3, 0x8f0ccc92, 0xffeff47d, 0x85845dd1,
+    0x6fa87e4f, 0xfe2ce6e0, 0xa3014314, 0x4e0811a1, 0xf7537e82, 0xbd3af235, 0x2ad7d2bb, 0xeb86d391,
+};
+
+static const uint32_t sha256Constants[64] = {
+    0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+    0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+    0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+    0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+    0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+    0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+    0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+    0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2,
+};
+
+static uint32_t loadLittleEndian(const unsigned char* p) {
+    return (uint32_t)p[0] | (uint32_t)p[1] << 8 | (uint32_t)p[2] << 16 | (uint32_t)p[3] << 24;
+}
+
+static uint32_t loadBigEndian(const unsigned char* p) {
+    return (uint32_t)p[0] << 24 | (uint32_t)p[1] << 16 | (uint32_t)p[2] << 8 | (uint32_t)p[3];
+}
+
+static void md5Block(uint32_t* state, const unsigned char* block) {
+    uint32_t m[16];
+    for (int i = 0; i < 16; i++) {
+        m[i] = loadLittleEndian(block + 4 * i);
+    }
+
+    uint32_t a = state[0], b = state[1], c = state[2], d = state[3];
+    for (int i = 0; i < 64; i++) {
+        uint32_t f;
+        int g;
+        if (i < 16) {
+            f = (b & c) | (~b & d);
+            g = i;
+        } else if (i < 32) {
+            f = (d & b) | (~d & c);
+            g = (5 * i + 1) % 16;
+        } else if (i < 48) {
+            f = b ^ c ^ d;
+            g = (3 * i + 5) % 16;
+        } else {
+            f = c ^ (b | ~d);
+            g = (7 * i) % 16;
+        }
+        f += a + md5Constants[i] + m[g];
+        a = d;
+        d = c;
+        c = b;
+        b += ROTL(f, md5Shifts[i]);
+    }
+    state[0] += a;
+    state[1] += b;
+    state[2] += c;
+    state[3] += d;
+}
+
+static void sha1Block(uint32_t* state, const unsigned char* block) {
+    uint32_t w[80];
+    for (int i = 0; i < 16; i++) {
+        w[i] = loadBigEndian(block + 4 * i);
+    }
+    for (int i = 16; i < 80; i++) {
+        w[i] = ROTL(w[i - 3] ^ w[i - 8] ^ w[i - 14] ^ w[i - 16], 1);
+    }
+
+    uint32_t a = state[0], b = state[1], c = state[2], d = state[3], e = state[4];
+    for (int i = 0; i < 80; i++) {
+        uint32_t f, k;
+        if (i < 20) {
+            f = (b & c) | (~b & d);
+            k = 0x5a827999;
+        } else if (i < 40) {
+            f = b ^ c ^ d;
+            k = 0x6ed9eba1;
+        } else if (i < 60) {
+            f = (b & c) | (b & d) | (c & d);
+            k = 0x8f1bbcdc;
+        } else {
+            f = b ^ c ^ d;
+            k = 0xca62c1d6;
+        }
+        uint32_t temp = ROTL(a, 5) + f + e + k + w[i];
+        e = d;
+        d = c;
+        c = ROTL(b, 30);
+        b = a;
+        a = temp;
+    }
+    state[0] += a;
+    state[1] += b;
+    state[2] += c;
+    state[3] += d;
+    state[4] += e;
+}
+
+static void sha256Block(uint32_t* state, const unsigned char* block) {
+    uint32_t w[64];
+    for (int i = 0; i < 16; i++) {
+        w[i] = loadBigEndian(block + 4 * i);
+    }
+    for (int i = 16; i < 64; i++) {
+        uint32_t s0 = ROTR(w[i - 15], 7) ^ ROTR(w[i - 15], 18) ^ (w[i - 15] >> 3);
+        uint32_t s1 = ROTR(w[i - 2], 17) ^ ROTR(w[i - 2], 19) ^ (w[i - 2] >> 10);
+        w[i] = w[i - 16] + s0 + w[i - 7] + s1;
+    }
+
+    uint32_t a = state[0], b = state[1], c = state[2], d = state[3];
+    uint32_t e = state[4], f = state[5], g = state[6], h = state[7];
+    for (int i = 0; i < 64; i++) {
+        uint32_t s1 = ROTR(e, 6) ^ ROTR(e, 11) ^ ROTR(e, 25);
+        uint32_t ch = (e & f) ^ (~e & g);
+        uint32_t temp1 = h + s1 + ch + sha256Constants[i] + w[i];
+        uint32_t s0 = ROTR(a, 2) ^ ROTR(a, 13) ^ ROTR(a, 22);
+        uint32_t maj = (a & b) ^ (a & c) ^ (b & c);
+        uint32_t temp2 = s0 + maj;
+        h = g;
+        g = f;
+        f = e;
+        e = d + temp1;
+        d = c;
+        c = b;
+        b = a;
+        a = temp1 + temp2;
+    }
+    state[0] += a;
+    state[1] += b;
+    state[2] += c;
+    state[3] += d;
+    state[4] += e;
+    state[5] += f;
+    state[6] += g;
+    state[7] += h;
+}
+
+static void processBlock(ChecksumContext* ctx, const unsigned char* block) {
+    switch (ctx->algorithm) {
+    case CHECKSUM_MD5:
+        md5Block(ctx->state, block);
+        break;
+    case CHECKSUM_SHA1:
+        sha1Block(ctx->state, block);
+        break;
+    default:
+        sha256Block(ctx->state, block);
+        break;
+    }
+}
+
+const char* checksumName(ChecksumAlgorithm algorithm) {
+    return checksumNames[algorithm];
+}
+
+size_t checksumDigestLength(ChecksumAlgorithm algorithm) {
+    return checksumDigestLengths[algorithm];
+}
+
+ChecksumAlgorithm checksumFromName(const char* name) {
+    for (int i = 0; i < CHECKSUM_COUNT; i++) {
+        if (strcasecmp(name, checksumNames[i]) == 0) {
+            return (ChecksumAlgorithm)i;
+        }
+    }
+    return CHECKSUM_COUNT;
+}
+
+void checksumInit(ChecksumContext* ctx, ChecksumAlgorithm algorithm) {
+    static const uint32_t md5Init[4] = { 0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476 };
+    static const uint32_t sha1Init[5] = { 0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476, 0xc3d2e1f0 };
+    static const uint32_t sha256Init[8] = {
+        0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19,
+    };
+
+    memset(ctx, 0, sizeof(*ctx));
+    ctx->algorithm = algorithm;
+    switch (algorithm) {
+    case CHECKSUM_MD5:
+        memcpy(ctx->state, md5Init, sizeof(md5Init));
+        break;
+    case CHECKSUM_SHA1:
+        memcpy(ctx->state, sha1Init, sizeof(sha1Init));
+        break;
+    default:
+        memcpy(ctx->state, sha256Init, sizeof(sha256Init));
+        break;
+    }
+}
+
+void checksumUpdate(ChecksumContext* ctx, const void* data, size_t length) {
+    const unsigned char* bytes = data;
+    ctx->length += length;
+
+    if (ctx->blockLength > 0) {
+        size_t fill = sizeof(ctx->block) - ctx->blockLength;
+        if (fill > length) {
+            fill = length;
+        }
+        memcpy(ctx->block + ctx->blockLength, bytes, fill);
+        ctx->blockLength += fill;
+        bytes += fill;
+        length -= fill;
+        if (ctx->blockLength < sizeof(ctx->block)) {
+            return;
+        }
+        processBlock(ctx, ctx->block);
+        ctx->blockLength = 0;
+    }
+
+    while (length >= sizeof(ctx->block)) {
+        processBlock(ctx, bytes);
+        bytes += sizeof(ctx->block);
+        length -= sizeof(ctx->block);
+    }
+
+    memcpy(ctx->block, bytes, length);
+    ctx->blockLength = length;
+}
+
+void checksumFinalHex(ChecksumContext* ctx, char* hex) {
+    // All three algorithms pad the same way and only differ in the byte
+    // order of the bit length and of the digest words
+    int littleEndian = ctx->algorithm == CHECKSUM_MD5;
+    uint64_t bitLength = ctx->length * 8;
+
+    unsigned char padding[72] = { 0x80 };
+    size_t paddingLength = (ctx->blockLength < 56 ? 56 : 120) - ctx->blockLength;
+    for (int i = 0; i < 8; i++) {
+        int shift = littleEndian ? 8 * i : 8 * (7 - i);
+        padding[paddingLength + i] = (unsigned char)(bitLength >> shift);
+    }
+    checksumUpdate(ctx, padding, paddingLength + 8);
+
+    size_t digestLength = checksumDigestLength(ctx->algorithm);
+    for (size_t i = 0; i < digestLength; i++) {
+        uint32_t word = ctx->state[i / 4];
+        int shift = littleEndian ? 8 * (i % 4) : 8 * (3 - i % 4);
+        sprintf(hex + 2 * i, "%02x", (unsigned int)(word >> shift) & 0xFF);
+    }
+    hex[2 * digestLength] = '\0';
+}
@@ -0,0 +1,38 @@
+#ifndef CHECKSUM_H
+#define CHECKSUM_H
+
+#include <stddef.h>
+#include <stdint.h>
+
+typedef enum {
+    CHECKSUM_MD5,
+    CHECKSUM_SHA1,
+    CHECKSUM_SHA256,
+    CHECKSUM_COUNT
+} ChecksumAlgorithm;
+
+#define CHECKSUM_MAX_DIGEST_LENGTH 32
+
+typedef struct {
+    ChecksumAlgorithm algorithm;
+    uint32_t state[8];
+    uint64_t length;
+    unsigned char block[64];
+    size_t blockLength;
+} ChecksumContext;
+
+const char* checksumName(ChecksumAlgorithm algorithm);
+size_t checksumDigestLength(ChecksumAlgorithm algorithm);
+
+// Returns the algorithm with the given (case-insensitive) name, or
+// CHECKSUM_COUNT if there is none
+ChecksumAlgorithm checksumFromName(const char* name);
+
+void checksumInit(ChecksumContext* ctx, ChecksumAlgorithm algorithm);
+void checksumUpdate(ChecksumContext* ctx, const void* data, size_t length);
+
+// Writes the digest as lowercase hex, hex must hold
+// 2 * CHECKSUM_MAX_DIGEST_LENGTH + 1 bytes
+void checksumFinalHex(ChecksumContext* ctx, char* hex);
+
+#endif
@@ -0,0 +1,62 @@
+#include <string.h>
+
+#include "decode.h"
+
+// Appends a code point to a UTF-8 string if it fits, returns the new length
+static size_t appendUtf8(char* result, size_t length, size_t size, uint32_t codePoint) {
+    char encoded[4];
+    size_t encodedLength;
+    if (codePoint < 0x80) {
+        encoded[0] = (char)codePoint;
+        encodedLength = 1;
+    } else if (codePoint < 0x800) {
+        encoded[0] = (char)(0xC0 | codePoint >> 6);
+        encoded[1] = (char)(0x80 | (codePoint & 0x3F));
+        encodedLength = 2;
+    } else if (codePoint < 0x10000) {
+        encoded[0] = (char)(0xE0 | codePoint >> 12);
+        encoded[1] = (char)(0x80 | (codePoint >> 6 & 0x3F));
+        encoded[2] = (char)(0x80 | (codePoint & 0x3F));
+        encodedLength = 3;
+    } else {
+        encoded[0] = (char)(0xF0 | codePoint >> 18);
+        encoded[1] = (char)(0x80 | (codePoint >> 12 & 0x3F));
+        encoded[2] = (char)(0x80 | (codePoint >> 6 & 0x3F));
+        encoded[3] = (char)(0x80 | (codePoint & 0x3F));
+        encodedLength = 4;
+    }
+
+    if (length + encodedLength >= size) {
+        return length;
+    }
+    memcpy(result + length, encoded, encodedLength);
+    return length + encodedLength;
+}
+
+void decodeUtf16(const int16_t* baseString, size_t length, char* resString, size_t size) {
+    size_t resLength = 0;
+    for (size_t i = 0; i < length && baseString[i] != 0; i++) {
+        uint32_t unit = (uint16_t)baseString[i];
+        if (unit >= 0xD800 && unit < 0xDC00 && i + 1 < length) {
+            uint32_t low = (uint16_t)baseString[i + 1];
+            if (low >= 0xDC00 && low < 0xE000) {
+                unit = 0x10000 + ((unit - 0xD800) << 10) + (low - 0xDC00);
+                i++;
+            }
+        }
+        if (unit >= 0xD800 && unit < 0xE000) {
+            unit = 0xFFFD;
+        }
+        resLength = appendUtf8(resString, resLength, size, unit);
+    }
+    resString[resLength] = '\0';
+}
+
+void decodeLatin1(const int16_t* baseString, size_t length, char* resString, size_t size) {
+    const unsigned char* bytes = (const unsigned char*)baseString;
+    size_t resLength = 0;
+    for (size_t i = 0; i < length * sizeof(int16_t) && bytes[i] != 0; i++) {
+        resLength = appendUtf8(resString, resLength, size, bytes[i]);
+    }
+    resString[resLength] = '\0';
+}
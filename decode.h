@@ -0,0 +1,18 @@
+#ifndef DECODE_H
+#define DECODE_H
+
+#include <stddef.h>
+#include <stdint.h>
+
+// Both decode a fixed-size name field of length units, which ends at the
+// first zero unit, into UTF-8 at resString, which holds size bytes (at
+// least 1). The result is always terminated and is cut short at a
+// character boundary if it doesn't fit.
+
+// Decodes UTF-16LE text; unpaired surrogates become U+FFFD
+void decodeUtf16(const int16_t* baseString, size_t length, char* resString, size_t size);
+
+// Decodes single-byte Latin-1 text stored in the units' bytes
+void decodeLatin1(const int16_t* baseString, size_t length, char* resString, size_t size);
+
+#endif
@@ -1,3 +1,4 @@
+#define _GNU_SOURCE // For O_DIRECT
 #include <stdlib.h>
 #include <stdio.h>
 #include <string.h>
@@ -7,12 +8,46 @@
 #include <unistd.h>
 #include <stdint.h>
 #include <sys/stat.h>
+#include <ctype.h>
+#include <strings.h>
+#include <stddef.h>
+#include <stdarg.h>
+#include <time.h>
+#include <iconv.h>
+#include <sys/wait.h>
+#include <signal.h>
+#include <math.h>
+
+#include "checksum.h"
+#include "decode.h"
 
 #define VERSION "1.1.0"
+// Version of the layout of every JSON document this tool writes. Bump it
+// whenever a key is removed or renamed or changes meaning.
+#define JSON_SCHEMA_VERSION 1
+#define CONFIG_FILE_NAME ".pacextractor.yaml"
+#define OUTPUT_ENV_VAR "PACEXTRACTOR_OUTPUT"
+#define DEFAULT_BUFFER_SIZE (256 * 1024) // 256 KB
+#define DEFAULT_WRITE_BUFFER_SIZE (64 * 1024) // 64 KB
+#define PROGRESS_INTERVAL 0.05 // Seconds between progress redraws, i.e. 20 Hz
+#define MAX_FD_TARGETS 16
+#define MAX_FILTER_COMMANDS 16
+#define CLAMP_TOLERANCE (64 * 1024) // How far -clamp lets a partition overrun the file
+#define DIRECT_IO_ALIGNMENT 4096 // Offsets, lengths and buffers of -direct reads
+#define ENTROPY_CHUNK_SIZE (64 * 1024)
+#define ENTROPY_CHUNK_COUNT 16 // Chunks sampled across each partition by -detect
+#define ENCRYPTED_ENTROPY 7.9 // Bits per byte above which -detect flags a partition
+
+#define ARRAY_LENGTH(array) (sizeof(array) / sizeof((array)[0]))
+
+// Exit status for a PAC without partitions under -strict
+#define EXIT_NO_PARTITIONS 2
 
 typedef struct {
-    int16_t someField[24];
-    int32_t someInt;
+    int16_t version[24];
+    // Size of the whole PAC in bytes, truncated to 32 bits. There is no
+    // magic number in the header, so this is the best signature there is.
+    uint32_t pacSize;
     int16_t productName[256];
     int16_t firmwareName[256];
     int32_t partitionCount;
@@ -34,259 +69,4748 @@ typedef struct {
     int32_t dataArray[];
 } PartitionHeader;
 
-static void getString(const int16_t* baseString, char* resString) {
-    if (baseString == NULL || resString == NULL) {
-        *resString = '\0';
+// Sizes of the on-disk headers; a change here means the parse changed too
+_Static_assert(sizeof(PacHeader) == 1220, "PacHeader must match the on-disk layout");
+_Static_assert(sizeof(PartitionHeader) == 1568, "PartitionHeader must match the on-disk layout");
+
+typedef enum {
+    SORT_INDEX,
+    SORT_SIZE,
+    SORT_NAME,
+    SORT_OFFSET,
+} SortOrder;
+
+// Which partition header field names a partition in listings and selections
+typedef enum {
+    NAME_FIELD_PARTITION,
+    NAME_FIELD_FILE,
+} NameField;
+
+typedef enum {
+    CHARSET_UTF16,
+    CHARSET_GBK,
+    CHARSET_LATIN1,
+} Charset;
+
+// A partition to write to an inherited file descriptor
+typedef struct {
+    char partitionName[256];
+    int fd;
+} FdTarget;
+
+// A shell command that -filter-cmd pipes a partition's data through
+typedef struct {
+    char partitionName[256];
+    const char* command;
+} FilterCommand;
+
+typedef struct {
+    const char* firmwarePath;
+    const char* outputPath;
+    int info;
+    int isPac;
+    int count;
+    int listSizes;
+    int probe;
+    int human;
+    int check;
+    int strict;
+    int quiet;
+    int bench;
+    int compact;
+    SortOrder sortOrder;
+    Charset charset;
+    NameField nameField;
+    int interactive;
+    int inferExtension;
+    int flatten;
+    int lowercaseNames;
+    int subdirPerPartition;
+    int fsync;
+    int allowDevice;
+    int preserveTime;
+    size_t bufferSize;
+    size_t writeBufferSize;
+    uint64_t minSize;
+    uint64_t maxSize;
+    uint64_t maxPartitionSize;
+    const char* statsJsonPath;
+    const char* summaryJsonPath;
+    int canonical;
+    const char* scriptPath;
+    const char* logFilePath;
+    const char* layoutPath;
+    const char* offsetsCsvPath;
+    int jsonl;
+    const char* sincePath;
+    int skipFdl;
+    int detect;
+    int listUnknownFields;
+    int groupSlots;
+    char slot; // 'a' or 'b' with -slot, otherwise 0
+    const char* onlyNames;
+    const char* excludeNames;
+    const char* typeNames;
+    const char* aliasPath;
+    const char* execCommand;
+    const char* expectSumsPath;
+    int keepGoing;
+    int skipBadHeaders;
+    int clamp;
+    int multi;
+    int ignoreMagic;
+    int noExtCheck;
+    FdTarget fdTargets[MAX_FD_TARGETS];
+    int fdTargetCount;
+    const char* stdoutPartition;
+    const char* combinePath;
+    const char* combineMapPath;
+    int fillGaps;
+    const char* carvePath;
+    uint64_t carveOffset;
+    uint64_t carveLength;
+    const char* partialName;
+    uint64_t partialOffset;
+    uint64_t partialLength;
+    const char* forceVersion;
+    unsigned int checksumAlgorithms; // Bit mask of ChecksumAlgorithm values
+    int crcCheck;
+    int direct;
+    int verifyComplete;
+    int progressFd;
+    const char* warningsJsonTarget;
+    FilterCommand filterCommands[MAX_FILTER_COMMANDS];
+    int filterCommandCount;
+    size_t crcOffset;
+    size_t crcWidth;
+} Options;
+
+typedef struct {
+    char partitionName[256];
+    char fileName[512];
+    uint32_t bytes;
+    double seconds;
+    // Everything else is only used for -summary-json
+    uint32_t partitionSize;
+    uint32_t partitionAddrInPac;
+    const char* skipReason;
+    char outputFileName[512];
+    char checksums[CHECKSUM_COUNT][2 * CHECKSUM_MAX_DIGEST_LENGTH + 1]; // Empty when not computed
+    const char* expectedSum; // "ok", "mismatch" or "missing" with -expect-sums
+    uint32_t clampedBytes;
+    int hookFailed;
+    int filtered; // Written through -filter-cmd, so of any size
+} PartitionStats;
+
+typedef struct {
+    int index;
+    const PartitionHeader* header;
+} PartitionListEntry;
+
+// A partition as recorded in a -save-layout file
+typedef struct {
+    char partitionName[256];
+    uint64_t partitionSize;
+    uint64_t partitionAddrInPac;
+    uint64_t pacOffset; // Of its PAC in a -multi layout, otherwise 0
+} ManifestEntry;
+
+// An "alias=name" line of the -alias-file
+typedef struct {
+    char alias[128];
+    char name[256];
+} NameAlias;
+
+// A line of the -expect-sums file
+typedef struct {
+    char hash[2 * CHECKSUM_MAX_DIGEST_LENGTH + 1];
+    char fileName[512];
+    int verified;
+} ExpectedSum;
+
+typedef struct {
+    char** words; // The option name, then its values
+    int count;
+} RecordedOption;
+
+typedef struct {
+    double lastTime;
+    uint32_t lastCompleted;
+    double rate; // Smoothed bytes per second, 0 until the first sample
+} ProgressRate;
+
+typedef struct {
+    const char* name;
+    size_t offset;
+    size_t size;
+} FieldLayout;
+
+#define FIELD_LAYOUT(type, field) { #field, offsetof(type, field), sizeof(((type*)0)->field) }
+
+static const FieldLayout pacHeaderLayout[] = {
+    FIELD_LAYOUT(PacHeader, version),
+    FIELD_LAYOUT(PacHeader, pacSize),
+    FIELD_LAYOUT(PacHeader, productName),
+    FIELD_LAYOUT(PacHeader, firmwareName),
+    FIELD_LAYOUT(PacHeader, partitionCount),
+    FIELD_LAYOUT(PacHeader, partitionsListStart),
+    FIELD_LAYOUT(PacHeader, someIntFields1),
+    FIELD_LAYOUT(PacHeader, productName2),
+    FIELD_LAYOUT(PacHeader, someIntFields2),
+    FIELD_LAYOUT(PacHeader, someIntFields3),
+};
+
+static const FieldLayout partitionHeaderLayout[] = {
+    FIELD_LAYOUT(PartitionHeader, length),
+    FIELD_LAYOUT(PartitionHeader, partitionName),
+    FIELD_LAYOUT(PartitionHeader, fileName),
+    FIELD_LAYOUT(PartitionHeader, partitionSize),
+    FIELD_LAYOUT(PartitionHeader, someFields1),
+    FIELD_LAYOUT(PartitionHeader, partitionAddrInPac),
+    FIELD_LAYOUT(PartitionHeader, someFields2),
+};
+
+typedef struct {
+    const char* type;
+    const char* extension;
+    size_t offset;
+    const char* magic;
+    size_t magicLength;
+} MagicSignature;
+
+static const MagicSignature magicSignatures[] = {
+    { "boot",   ".img", 0,     "ANDROID!",         8 },
+    { "sparse", ".img", 0,     "\x3a\xff\x26\xed", 4 },
+    { "ext4",   ".img", 0x438, "\x53\xef",         2 },
+    { "xml",    ".xml", 0,     "<?xml",            5 },
+    { "gzip",   ".gz",  0,     "\x1f\x8b",         2 },
+};
+
+// Format versions found in the version field of PAC headers this parser is
+// known to handle. All of them share the layout of PacHeader/PartitionHeader.
+static const char* const knownFormatVersions[] = {
+    "BP_R1.0.0",
+    "BP_R2.0.1",
+};
+
+// Largest offset + length of any signature, i.e. how much data to peek
+#define MAGIC_PEEK_SIZE 0x440
+
+// Partitions picked in -interactive mode, indexed like the partition table;
+// NULL when every partition is a candidate
+static unsigned char* interactiveSelection = NULL;
+
+// Alternative names -only and -exclude accept, from -alias-file
+static NameAlias* nameAliases = NULL;
+static int nameAliasCount = 0;
+
+// Content type of each partition for -type, from its magic or "unknown",
+// indexed like the partition table; NULL without -type
+static const char** detectedTypes = NULL;
+
+// Position in the partition table of each header that was read. It is past
+// the partition's index in partHeaders once -skip-bad-headers has stepped
+// over a header, and it is what users see and select by.
+static int* headerIndices = NULL;
+
+// Output file names handed out so far, to avoid collisions in -flatten and
+// -lowercase-names mode
+static char** usedOutputNames = NULL;
+static int usedOutputNameCount = 0;
+
+// Where -jsonl writes its records. Everything else printed to stdout goes to
+// stderr while it is set, so the stream only holds JSON.
+static FILE* jsonlOutput = NULL;
+
+// The real stdout in -stdout-partition mode, set up like -jsonl so the
+// partition data is the only thing written to it
+static int stdoutPartitionFd = -1;
+
+// The firmware file opened a second time with O_DIRECT for -direct, or -1
+// when partition data goes through the page cache. O_DIRECT needs aligned
+// reads, so they land in directBuffer first.
+static int directFd = -1;
+static char* directBuffer = NULL;
+
+// Partitions that failed but were let through by -keep-going
+static int failedPartitionCount = 0;
+
+// Partitions of the -since layout file
+static ManifestEntry* sinceManifest = NULL;
+static int sinceManifestCount = 0;
+
+// Expected SHA-256 sums from -expect-sums and how many extracted files
+// matched them, didn't, or had none
+static ExpectedSum* expectedSums = NULL;
+static int expectedSumCount = 0;
+static int sumsPassed = 0;
+static int sumsFailed = 0;
+static int sumsMissing = 0;
+
+// Where the PAC being processed starts in the file; only nonzero for the
+// later PACs of a -multi dump. Every offset in the headers is relative to it.
+static off_t pacBase = 0;
+
+// Options from the config file and then the command line, in the order
+// they were applied, so -emit-script can replay them
+static RecordedOption* recordedOptions = NULL;
+static int recordedOptionCount = 0;
+
+static Options options = {
+    .bufferSize = DEFAULT_BUFFER_SIZE,
+    .writeBufferSize = DEFAULT_WRITE_BUFFER_SIZE,
+    .maxSize = UINT64_MAX,
+    .maxPartitionSize = UINT64_MAX,
+    .progressFd = -1,
+    // Which partition header field (if any) holds a CRC is not known yet;
+    // the first of someFields2 is only a starting guess
+    .crcOffset = offsetof(PartitionHeader, someFields2),
+    .crcWidth = 4,
+};
+
+// Set by -log-file; everything printed by the log functions below is also
+// written there with a timestamp on each line
+static FILE* logFile = NULL;
+
+// Where -warnings-json writes warnings, which then don't go to stderr
+static FILE* warningsJson = NULL;
+
+static void writeLogFile(const char* prefix, const char* format, va_list args) {
+    if (logFile == NULL) {
         return;
     }
 
-    while (*baseString) {
-        *resString++ = (char)(*baseString & 0xFF);
-        baseString++;
-        if (resString - resString > 255) { // Prevent buffer overflow
-            break;
-        }
+    char message[4096];
+    vsnprintf(message, sizeof(message), format, args);
+
+    char timestamp[32];
+    time_t now = time(NULL);
+    strftime(timestamp, sizeof(timestamp), "%Y-%m-%d %H:%M:%S", localtime(&now));
+
+    // Blank lines only separate progress output on the console
+    for (char* line = strtok(message, "\n"); line != NULL; line = strtok(NULL, "\n")) {
+        fprintf(logFile, "%s %s%s\n", timestamp, prefix, line);
     }
-    *resString = '\0'; // Null-terminate the result string
+    fflush(logFile);
 }
 
-static void printUsage(void) {
-    printf("Usage: pacextractor -e <firmware name>.pac -o <output path>\n");
-    printf("Options:\n");
-    printf("  -h               Show this help message and exit\n");
-    printf("  -v               Show version information and exit\n");
+// Writes to the log file only, for summaries of console-only output such
+// as progress bars
+static void logToFile(const char* format, ...) {
+    va_list args;
+    va_start(args, format);
+    writeLogFile("", format, args);
+    va_end(args);
 }
 
-static void printUsageAndExit(void) {
-    printUsage();
-    exit(EXIT_FAILURE);
-}
+// Prints informational output, which -quiet and -bench suppress on the
+// console. Errors go straight to stderr and are never suppressed.
+static void logInfo(const char* format, ...) {
+    va_list args;
+    va_start(args, format);
+    writeLogFile("", format, args);
+    va_end(args);
 
-static void handleOpenFileError(const char* fileName) {
-    perror(fileName);
-    exit(EXIT_FAILURE);
+    if (options.quiet || options.bench) {
+        return;
+    }
+    va_start(args, format);
+    vprintf(format, args);
+    va_end(args);
 }
 
-static int openFirmwareFile(const char* filePath) {
-    int fd = open(filePath, O_RDONLY);
-    if (fd == -1) {
-        handleOpenFileError(filePath);
+// Like logInfo, but for the one result -bench asks for, so only -quiet
+// keeps it off the console
+static void logResult(const char* format, ...) {
+    va_list args;
+    va_start(args, format);
+    writeLogFile("", format, args);
+    va_end(args);
+
+    if (options.quiet) {
+        return;
     }
-    return fd;
+    va_start(args, format);
+    vprintf(format, args);
+    va_end(args);
 }
 
-static void createOutputDirectory(const char* path) {
-    char temp[768];
-    strcpy(temp, path);
-    for (char *p = temp; *p; p++) {
-        if (*p == '/') {
-            *p = 0;  // Temporarily terminate the string
-            if (access(temp, F_OK) == -1) {
-                if (mkdir(temp, 0777) == -1) {
-                    perror("Failed to create output directory");
-                    exit(EXIT_FAILURE);
-                }
-            }
-            *p = '/';  // Restore the string
+static void writeJsonString(FILE* file, const char* text) {
+    fputc('"', file);
+    for (const unsigned char* c = (const unsigned char*)text; *c; c++) {
+        if (*c == '"' || *c == '\\') {
+            fprintf(file, "\\%c", *c);
+        } else if (*c < 0x20) {
+            fprintf(file, "\\u%04x", *c);
+        } else {
+            fputc(*c, file);
         }
     }
-    if (access(temp, F_OK) == -1) {
-        if (mkdir(temp, 0777) == -1) {
-            perror("Failed to create output directory");
-            exit(EXIT_FAILURE);
+    fputc('"', file);
+}
+
+// Prints a warning to stderr unless -quiet, or with -warnings-json writes it there as a
+// JSON record instead. code names the kind of warning for tools to match
+// on; partition is the name of the partition it is about, or NULL.
+static void logWarning(const char* code, const char* partition, const char* format, ...) {
+    va_list args;
+    va_start(args, format);
+    writeLogFile("Warning: ", format, args);
+    va_end(args);
+
+    if (warningsJson != NULL) {
+        char message[1024];
+        va_start(args, format);
+        vsnprintf(message, sizeof(message), format, args);
+        va_end(args);
+        fprintf(warningsJson, "{\"schema_version\": %d, \"tool_version\": \"%s\", \"code\": \"%s\", \"partition\": ",
+                JSON_SCHEMA_VERSION, VERSION, code);
+        if (partition != NULL) {
+            writeJsonString(warningsJson, partition);
+        } else {
+            fputs("null", warningsJson);
         }
+        fprintf(warningsJson, ", \"message\": ");
+        writeJsonString(warningsJson, message);
+        fprintf(warningsJson, "}\n");
+        fflush(warningsJson);
+        return;
     }
-}
 
-static PacHeader readPacHeader(int fd) {
-    PacHeader header;
-    if (read(fd, &header, sizeof(PacHeader)) != sizeof(PacHeader)) {
-        perror("Error while reading PAC header");
-        exit(EXIT_FAILURE);
+    // -strict counts anomalies itself, so silencing the text changes no outcome
+    if (options.quiet) {
+        return;
     }
-    return header;
+
+    va_start(args, format);
+    fprintf(stderr, "Warning: ");
+    vfprintf(stderr, format, args);
+    fprintf(stderr, "\n");
+    va_end(args);
 }
 
-static PartitionHeader* readPartitionHeader(int fd, uint32_t* curPos) {
-    lseek(fd, *curPos, SEEK_SET);
-    uint32_t length;
-    if (read(fd, &length, sizeof(length)) != sizeof(length)) {
-        perror("Error while reading partition header length");
-        exit(EXIT_FAILURE);
-    }
-    
-    PartitionHeader* header = malloc(length);
-    if (header == NULL) {
-        perror("Memory allocation failed");
+static void logError(const char* format, ...) {
+    va_list args;
+    va_start(args, format);
+    writeLogFile("Error: ", format, args);
+    va_end(args);
+
+    va_start(args, format);
+    vfprintf(stderr, format, args);
+    va_end(args);
+}
+
+// Like perror, but also logged to the log file
+static void logErrno(const char* message) {
+    int savedErrno = errno;
+    logError("%s: %s\n", message, strerror(savedErrno));
+    errno = savedErrno;
+}
+
+// Decodes a name field holding GBK text instead of UTF-16; anything that
+// can't be converted ends the string with a '?'
+static void decodeGbk(const int16_t* baseString, size_t length, char* resString, size_t size) {
+    char* in = (char*)baseString;
+    size_t inLength = strnlen(in, length * sizeof(int16_t));
+    char* out = resString;
+    size_t outLength = size - 1;
+
+    iconv_t cd = iconv_open("UTF-8", "GBK");
+    if (cd == (iconv_t)-1) {
+        logErrno("GBK decoding is not available");
         exit(EXIT_FAILURE);
     }
-    
-    lseek(fd, *curPos, SEEK_SET);
-    if (read(fd, header, length) != length) {
-        perror("Error while reading partition header");
-        free(header);
-        exit(EXIT_FAILURE);
+    if (iconv(cd, &in, &inLength, &out, &outLength) == (size_t)-1 && outLength > 0) {
+        *out++ = '?';
     }
-    
-    *curPos += length;
-    return header;
+    iconv_close(cd);
+    *out = '\0';
 }
 
-static void printProgressBar(uint32_t completed, uint32_t total) {
-    const int barWidth = 50;
-    float progress = (float)completed / total;
-    int pos = barWidth * progress;
+// Decodes a fixed-size name field of length units into resString, which
+// holds size bytes, using the -charset encoding
+static void getString(const int16_t* baseString, size_t length, char* resString, size_t size) {
+    if (baseString == NULL || resString == NULL) {
+        if (resString != NULL && size > 0) {
+            *resString = '\0';
+        }
+        return;
+    }
 
-    // Determine color based on progress
-    const char* color;
-    if (progress < 0.5) {
-        color = "\033[31m"; // Red
-    } else if (progress < 0.8) {
-        color = "\033[33m"; // Yellow
+    switch (options.charset) {
+    case CHARSET_LATIN1:
+        decodeLatin1(baseString, length, resString, size);
+        break;
+    case CHARSET_GBK:
+        decodeGbk(baseString, length, resString, size);
+        break;
+    default:
+        decodeUtf16(baseString, length, resString, size);
+        break;
+    }
+}
+
+// Every listing and selection goes through here, so -name-field decides
+// which field they all use
+static void getPartitionName(const PartitionHeader* partHeader, char* name, size_t size) {
+    if (options.nameField == NAME_FIELD_FILE) {
+        getString(partHeader->fileName, ARRAY_LENGTH(partHeader->fileName), name, size);
     } else {
-        color = "\033[32m"; // Green
+        getString(partHeader->partitionName, ARRAY_LENGTH(partHeader->partitionName), name, size);
     }
-    const char* reset = "\033[0m"; // Reset color
+}
 
-    printf("\r[%s", color);
-    for (int i = 0; i < barWidth; ++i) {
-        if (i < pos) printf("=");
-        else if (i == pos) printf(">");
-        else printf(" ");
+static void getFileName(const PartitionHeader* partHeader, char* name, size_t size) {
+    getString(partHeader->fileName, ARRAY_LENGTH(partHeader->fileName), name, size);
+}
+
+static void printFieldLayout(const char* name, size_t size, const FieldLayout* fields, size_t count) {
+    printf("%s (%zu bytes)\n", name, size);
+    printf("  offset        size  field\n");
+    for (size_t i = 0; i < count; i++) {
+        printf("  0x%04zx %4zu  %5zu  %s\n", fields[i].offset, fields[i].offset, fields[i].size, fields[i].name);
     }
-    printf("]%s %.2f%%", reset, progress * 100.0);
-    fflush(stdout);
 }
 
-static void extractPartition(int fd, const PartitionHeader* partHeader, const char* outputPath) {
-    if (partHeader->partitionSize == 0) {
-        return;
+// Prints where each header field is expected, to compare with a hex dump
+static void printHeaderLayout(void) {
+    printFieldLayout("PacHeader", sizeof(PacHeader), pacHeaderLayout, ARRAY_LENGTH(pacHeaderLayout));
+    printf("\n");
+    printFieldLayout("PartitionHeader", sizeof(PartitionHeader), partitionHeaderLayout,
+                     ARRAY_LENGTH(partitionHeaderLayout));
+    printf("Partition headers may be longer, as given by their length field.\n");
+}
+
+static void printUsage(void) {
+    printf("Usage: pacextractor -e <firmware name>.pac -o <output path>\n");
+    printf("       pacextractor -e <firmware name>.pac -info\n");
+    printf("       pacextractor -report <firmware name>.pac...\n");
+    printf("Options:\n");
+    printf("  -h               Show this help message and exit\n");
+    printf("  -v               Show version information and exit\n");
+    printf("  -layout          Show the offset and size of every header field and exit\n");
+    printf("  -info            Only print the PAC header and partition table; reads no\n");
+    printf("                   partition data unless -checksum-algo, -type or -detect asks\n");
+    printf("                   for it, so a file cut short after its headers works\n");
+    printf("  -report <files>  Show which unknown header fields are constant across a set of\n");
+    printf("                   PACs and which vary; takes no other options\n");
+    printf("  -selftest        Extract a generated PAC and check the result, to make sure\n");
+    printf("                   this build works on this system; takes no other options\n");
+    printf("  -is-pac          Only print whether the file looks like a PAC (true or\n");
+    printf("                   false) and exit with status 0 or 1 accordingly\n");
+    printf("  -count           Only print the number of partitions\n");
+    printf("  -probe           Only parse the headers under a few candidate layouts and\n");
+    printf("                   print them ranked by how consistent the result is\n");
+    printf("  -list-sizes      Only print a name<TAB>size line for each partition\n");
+    printf("  -human           Print -list-sizes sizes with units, e.g. 33.5 MiB\n");
+    printf("  -check           Only check the headers for format anomalies and report the\n");
+    printf("                   alignment of each partition's data\n");
+    printf("  -strict          Check the headers and refuse to extract if anything is off;\n");
+    printf("                   a PAC without partitions exits with status %d\n", EXIT_NO_PARTITIONS);
+    printf("  -verify-complete After extracting, check that every selected partition left a\n");
+    printf("                   file of its size, or any size after -filter-cmd; under\n");
+    printf("                   -strict a missing one is an error\n");
+    printf("  -skip-bad-headers Step over partition headers that are cut off or have an\n");
+    printf("                   impossible length instead of stopping\n");
+    printf("  -clamp           Cut short partitions that reach at most %d KiB past the\n", CLAMP_TOLERANCE / 1024);
+    printf("                   end of the file instead of failing on them\n");
+    printf("  -ignore-magic    Don't check the PAC size field against the file size,\n");
+    printf("                   e.g. for PACs from tools that leave it zero\n");
+    printf("  -no-ext-check    Don't warn when the firmware file name doesn't end in .pac\n");
+    printf("  -force-version <v> Treat the PAC as format version v, e.g. BP_R1.0.0\n");
+    printf("  -save-layout <file> Save every PAC and partition header field as JSON\n");
+    printf("  -offsets-csv <file> Write name,offset,size rows with the absolute file\n");
+    printf("                   offset of each partition's data\n");
+    printf("  -carve <offset:length> <file> Only copy the given byte range of the whole file,\n");
+    printf("                   e.g. 0:1220 for the PAC header, to file\n");
+    printf("  -combine <file>  Only write the selected partitions, in offset order, into one\n");
+    printf("                   image\n");
+    printf("  -combine-map <file> Write name,offset,size rows for each partition in the\n");
+    printf("                   -combine image\n");
+    printf("  -fill-gaps       Zero-fill the gaps between partitions in the -combine image,\n");
+    printf("                   keeping them at the same distances as in the PAC\n");
+    printf("  -jsonl           Write one JSON object per partition to stdout as its header\n");
+    printf("                   is read, and all other output to stderr; the headers are\n");
+    printf("                   still all kept in memory for the rest of the run\n");
+    printf("  -warnings-json <fd|file> Write warnings as JSON objects with a code, partition\n");
+    printf("                   and message, one per line, to a file descriptor or file\n");
+    printf("                   instead of stderr\n");
+    printf("  -charset <name>  Decode names as utf16 (default), gbk or latin1\n");
+    printf("  -name-field <f>  Name partitions in listings and selections by their\n");
+    printf("                   partition (default) or file name field\n");
+    printf("  -sort <order>    List partitions by index (default), size, name or offset\n");
+    printf("  -quiet           Print nothing but errors\n");
+    printf("  -log-file <file> Also write all output, with timestamps, to a file\n");
+    printf("  -compact         Print one line per extracted partition with its size,\n");
+    printf("                   time and throughput\n");
+    printf("  -bench           Skip progress and per-partition output and report the\n");
+    printf("                   total throughput at the end\n");
+    printf("  -stats-json <file> Write per-partition and overall timing and throughput\n");
+    printf("                   to a JSON file\n");
+    printf("  -emit-script <file> Write a shell script that reruns this extraction with\n");
+    printf("                   the same settings, including config file defaults\n");
+    printf("  -no-config       Ignore the config file and $%s\n", OUTPUT_ENV_VAR);
+    printf("  -summary-json <file> Write the header fields, outcome, checksums and timing\n");
+    printf("                   of every partition to one JSON file\n");
+    printf("  -canonical       Write the -summary-json file with sorted keys and without\n");
+    printf("                   timings, so runs on the same PAC give identical files;\n");
+    printf("                   the other JSON files keep their usual order\n");
+    printf("  -infer-ext       Append an extension detected from the partition data\n");
+    printf("                   to file names that have none\n");
+    printf("  -max-partition-size <n> Refuse partitions declaring more than n bytes:\n");
+    printf("                   skip them with a warning, or fail under -strict\n");
+    printf("  -interactive     Ask which partitions to extract, e.g. 0,2,4-6 or all\n");
+    printf("  -min-size <n>    Skip partitions smaller than n, e.g. 64K\n");
+    printf("  -max-size <n>    Skip partitions larger than n, e.g. 2G\n");
+    printf("  -flatten         Write files from subdirectories of the PAC to the output\n");
+    printf("                   root, replacing '/' with '_' in their names\n");
+    printf("  -subdir-per-partition Write each partition into a directory named after it\n");
+    printf("  -lowercase-names Lowercase output file names, for case-insensitive file\n");
+    printf("                   systems; clashing names get the partition index added\n");
+    printf("  -since <file>    Only extract partitions whose size or offset differs from\n");
+    printf("                   a layout saved earlier with -save-layout; under -multi, each\n");
+    printf("                   PAC is compared with the one at the same offset\n");
+    printf("  -only <names>    Only extract the partitions named in a comma-separated list\n");
+    printf("  -exclude <names> Don't extract the partitions named in a comma-separated\n");
+    printf("                   list; applied after -only\n");
+    printf("  -alias-file <file> Let -only and -exclude also take the aliases defined\n");
+    printf("                   by \"alias=name\" lines, e.g. kernel=boot\n");
+    printf("  -type <types>    Only extract partitions whose data is one of a comma-separated\n");
+    printf("                   list of boot, sparse, ext4, xml, gzip and unknown\n");
+    printf("  -detect          Show the data type and entropy of each partition, flagging\n");
+    printf("                   likely encrypted ones\n");
+    printf("  -group-slots     List A/B partitions, e.g. boot_a and boot_b, together\n");
+    printf("  -slot <a|b>      Skip the partitions of the other A/B slot; partitions\n");
+    printf("                   without a slot are extracted as usual\n");
+    printf("  -list-unknown-fields Show the unknown someFields1 and someFields2 values of\n");
+    printf("                   each partition header in hex and decimal\n");
+    printf("  -skip-fdl        Skip the FDL1/FDL2 download agents, which are loaded into\n");
+    printf("                   RAM by the flash tool rather than flashed\n");
+    printf("  -extract-to-fd <name:fd> Only write the named partition to the already open\n");
+    printf("                   file descriptor fd, e.g. boot:3; may be repeated\n");
+    printf("  -stdout-partition <name> Only write the named partition to stdout, and its\n");
+    printf("                   name and size to stderr\n");
+    printf("  -progress-fd <fd> Write partition<TAB>bytes<TAB>total progress lines to the\n");
+    printf("                   already open file descriptor fd, ending with one per partition\n");
+    printf("  -partial-extract <name:offset:length> Only write the given slice of one\n");
+    printf("                   partition, e.g. system:0:4M, to <file name>.partial\n");
+    printf("  -preserve-time   Give extracted files the modification time of the PAC file,\n");
+    printf("                   as a fallback: no header field is known to hold a build time\n");
+    printf("  -allow-device    Write partitions whose output path is a block or character\n");
+    printf("                   device onto the device in place, e.g. an SD card partition\n");
+    printf("  -fsync           Sync each output file to disk, and their directories once\n");
+    printf("                   at the end\n");
+    printf("  -multi           Also process the PACs that follow the first one in the\n");
+    printf("                   file, extracting PAC n to <output path>/pac<n>; the JSON\n");
+    printf("                   files hold an array with one document per PAC, and the\n");
+    printf("                   CSV files a set of rows per PAC\n");
+    printf("  -exec <command>  Run a shell command after each partition is extracted;\n");
+    printf("                   {file}, {partition} and {size} are replaced with the\n");
+    printf("                   output file, partition name and size\n");
+    printf("  -filter-cmd <name:command> Pipe the named partition through a shell command,\n");
+    printf("                   e.g. a decryptor, and write what it prints as the output file;\n");
+    printf("                   may be repeated\n");
+    printf("  -keep-going      Carry on with the next partition when -exec or -filter-cmd\n");
+    printf("                   fails, and exit with status 1 at the end\n");
+    printf("  -buffer-size <n> Size of the copy buffer, e.g. 256K or 4M (default 256K)\n");
+    printf("  -direct          Read partition data with O_DIRECT, bypassing the page cache;\n");
+    printf("                   falls back to normal reads where it isn't supported\n");
+    printf("  -write-buffer <n> Size of the output file buffer (default 64K)\n");
+    printf("  -expect-sums <file> Verify the SHA-256 of each extracted file against a\n");
+    printf("                   file in sha256sum format and fail on any mismatch; the\n");
+    printf("                   data is hashed as stored in the PAC, before any -filter-cmd\n");
+    printf("  -checksum-algo <list> Print the given digests of each partition, from\n");
+    printf("                   md5, sha1 and sha256, e.g. md5,sha256; with -info,\n");
+    printf("                   print the digests of the whole PAC file instead\n");
+    printf("  -crc-check       Compute a CRC32 of each partition and compare it to a\n");
+    printf("                   field of its partition header\n");
+    printf("  -crc-offset <n>  Byte offset of that field in the partition header (default %zu)\n",
+           offsetof(PartitionHeader, someFields2));
+    printf("  -crc-width <n>   Width of that field in bytes: 1, 2 or 4 (default 4)\n");
+    printf("\n");
+    printf("Defaults for any option can be set in ~/%s using \"name: value\"\n", CONFIG_FILE_NAME);
+    printf("lines, where name is the option without its leading dash, e.g.\n");
+    printf("\"buffer-size: 1M\" or \"infer-ext: true\". Command line options win; a\n");
+    printf("flag set there is turned off again with its -no- form, e.g. -no-quiet.\n");
+    printf("The output path defaults to $%s if it is set.\n", OUTPUT_ENV_VAR);
+}
+
+static void printUsageAndExit(void) {
+    printUsage();
+    exit(EXIT_FAILURE);
+}
+
+// Parses a byte count with an optional K, M, G or T suffix (powers of 1024),
+// also accepting the KB/KiB spellings. Returns 0 on success.
+static int parseSize(const char* text, uint64_t* size) {
+    char* end;
+    errno = 0;
+    unsigned long long value = strtoull(text, &end, 10);
+    if (end == text || errno != 0 || *text == '-') {
+        return -1;
     }
 
-    lseek(fd, partHeader->partitionAddrInPac, SEEK_SET);
+    uint64_t multiplier = 1;
+    if (*end != '\0') {
+        const char* units = "KMGT";
+        const char* unit = strchr(units, toupper((unsigned char)*end));
+        if (unit == NULL) {
+            return -1;
+        }
+        for (const char* u = units; u <= unit; u++) {
+            multiplier *= 1024;
+        }
+        end++;
+        if (strcasecmp(end, "") != 0 && strcasecmp(end, "B") != 0 && strcasecmp(end, "iB") != 0) {
+            return -1;
+        }
+    }
 
-    // Increase buffer size for faster I/O operations
-    const size_t BUFFER_SIZE = 256 * 1024; // 256 KB
-    char* buffer = malloc(BUFFER_SIZE);
-    if (buffer == NULL) {
-        perror("Memory allocation failed");
-        exit(EXIT_FAILURE);
+    if (value > UINT64_MAX / multiplier) {
+        return -1;
     }
+    *size = value * multiplier;
+    return 0;
+}
 
-    char outputFilePath[768];
-    char fileName[512];
-    getString(partHeader->fileName, fileName);
-    snprintf(outputFilePath, sizeof(outputFilePath), "%s/%s", outputPath, fileName);
+static char* trimWhitespace(char* text) {
+    while (isspace((unsigned char)*text)) {
+        text++;
+    }
+    char* end = text + strlen(text);
+    while (end > text && isspace((unsigned char)end[-1])) {
+        *--end = '\0';
+    }
+    return text;
+}
 
-    if (remove(outputFilePath) == -1 && errno != ENOENT) {
-        perror("Error removing existing output file");
-        free(buffer);
-        exit(EXIT_FAILURE);
+// Returns whether every entry of a comma-separated -type list names a
+// magic signature or is "unknown"
+static int isValidTypeList(const char* list) {
+    while (*list) {
+        size_t length = strcspn(list, ",");
+        int known = length == strlen("unknown") && strncmp(list, "unknown", length) == 0;
+        for (size_t i = 0; i < ARRAY_LENGTH(magicSignatures) && !known; i++) {
+            known = strlen(magicSignatures[i].type) == length && strncmp(list, magicSignatures[i].type, length) == 0;
+        }
+        if (!known) {
+            return 0;
+        }
+        list += length;
+        if (*list == ',') {
+            list++;
+        }
     }
+    return 1;
+}
 
-    int fd_new = open(outputFilePath, O_WRONLY | O_CREAT | O_TRUNC, 0666);
-    if (fd_new == -1) {
-        perror("Error creating output file");
-        free(buffer);
-        exit(EXIT_FAILURE);
+static int isTypeListed(const char* type, const char* list) {
+    size_t typeLength = strlen(type);
+    while (*list) {
+        size_t length = strcspn(list, ",");
+        if (length == typeLength && strncmp(list, type, length) == 0) {
+            return 1;
+        }
+        list += length;
+        if (*list == ',') {
+            list++;
+        }
     }
+    return 0;
+}
 
-    printf("Extracting to %s\n", outputFilePath);
+// Sets or, for the -no- form of a flag, clears an option that takes no
+// value. Returns whether name is such a flag.
+static int parseFlag(const char* name, int enable) {
+    if (strcmp(name, "-info") == 0) {
+        options.info = enable;
+    } else if (strcmp(name, "-is-pac") == 0) {
+        options.isPac = enable;
+    } else if (strcmp(name, "-list-sizes") == 0) {
+        options.listSizes = enable;
+    } else if (strcmp(name, "-human") == 0) {
+        options.human = enable;
+    } else if (strcmp(name, "-probe") == 0) {
+        options.probe = enable;
+    } else if (strcmp(name, "-count") == 0) {
+        options.count = enable;
+    } else if (strcmp(name, "-check") == 0) {
+        options.check = enable;
+    } else if (strcmp(name, "-strict") == 0) {
+        options.strict = enable;
+    } else if (strcmp(name, "-verify-complete") == 0) {
+        options.verifyComplete = enable;
+    } else if (strcmp(name, "-skip-bad-headers") == 0) {
+        options.skipBadHeaders = enable;
+    } else if (strcmp(name, "-clamp") == 0) {
+        options.clamp = enable;
+    } else if (strcmp(name, "-ignore-magic") == 0) {
+        options.ignoreMagic = enable;
+    } else if (strcmp(name, "-no-ext-check") == 0) {
+        options.noExtCheck = enable;
+    } else if (strcmp(name, "-fill-gaps") == 0) {
+        options.fillGaps = enable;
+    } else if (strcmp(name, "-jsonl") == 0) {
+        options.jsonl = enable;
+    } else if (strcmp(name, "-quiet") == 0) {
+        options.quiet = enable;
+    } else if (strcmp(name, "-compact") == 0) {
+        options.compact = enable;
+    } else if (strcmp(name, "-bench") == 0) {
+        options.bench = enable;
+    } else if (strcmp(name, "-canonical") == 0) {
+        options.canonical = enable;
+    } else if (strcmp(name, "-infer-ext") == 0) {
+        options.inferExtension = enable;
+    } else if (strcmp(name, "-flatten") == 0) {
+        options.flatten = enable;
+    } else if (strcmp(name, "-subdir-per-partition") == 0) {
+        options.subdirPerPartition = enable;
+    } else if (strcmp(name, "-lowercase-names") == 0) {
+        options.lowercaseNames = enable;
+    } else if (strcmp(name, "-detect") == 0) {
+        options.detect = enable;
+    } else if (strcmp(name, "-group-slots") == 0) {
+        options.groupSlots = enable;
+    } else if (strcmp(name, "-list-unknown-fields") == 0) {
+        options.listUnknownFields = enable;
+    } else if (strcmp(name, "-skip-fdl") == 0) {
+        options.skipFdl = enable;
+    } else if (strcmp(name, "-preserve-time") == 0) {
+        options.preserveTime = enable;
+    } else if (strcmp(name, "-allow-device") == 0) {
+        options.allowDevice = enable;
+    } else if (strcmp(name, "-fsync") == 0) {
+        options.fsync = enable;
+    } else if (strcmp(name, "-multi") == 0) {
+        options.multi = enable;
+    } else if (strcmp(name, "-keep-going") == 0) {
+        options.keepGoing = enable;
+    } else if (strcmp(name, "-direct") == 0) {
+        options.direct = enable;
+    } else if (strcmp(name, "-interactive") == 0) {
+        options.interactive = enable;
+    } else if (strcmp(name, "-crc-check") == 0) {
+        options.crcCheck = enable;
+    } else {
+        return 0;
+    }
+    return 1;
+}
 
-    uint32_t dataSizeLeft = partHeader->partitionSize;
-    uint32_t dataSizeRead = 0;
+// Applies the option at argv[i]. Returns how many arguments it consumed,
+// or 0 if argv[i] isn't a known option or its value is missing or invalid.
+static int parseOption(int argc, char** argv, int i) {
+    const char* name = argv[i];
+    char* value = i + 1 < argc ? argv[i + 1] : NULL;
 
-    while (dataSizeLeft > 0) {
-        uint32_t copyLength = (dataSizeLeft > BUFFER_SIZE) ? BUFFER_SIZE : dataSizeLeft;
-        ssize_t rb = read(fd, buffer, copyLength);
-        if (rb != copyLength) {
-            perror("Error while reading partition data");
-            close(fd_new);
-            free(buffer);
-            exit(EXIT_FAILURE);
+    // Every flag can be turned off again with a -no- prefix, e.g. -no-quiet,
+    // to override a config file default
+    if (parseFlag(name, 1) || (strncmp(name, "-no-", 4) == 0 && parseFlag(name + 3, 0))) {
+        return 1;
+    }
+    if (strcmp(name, "-e") == 0 && value) {
+        options.firmwarePath = value;
+        return 2;
+    } else if (strcmp(name, "-o") == 0 && value) {
+        options.outputPath = value;
+        return 2;
+    } else if (strcmp(name, "-force-version") == 0 && value) {
+        options.forceVersion = value;
+        return 2;
+    } else if (strcmp(name, "-save-layout") == 0 && value) {
+        options.layoutPath = value;
+        return 2;
+    } else if (strcmp(name, "-offsets-csv") == 0 && value) {
+        options.offsetsCsvPath = value;
+        return 2;
+    } else if (strcmp(name, "-combine") == 0 && value) {
+        options.combinePath = value;
+        return 2;
+    } else if (strcmp(name, "-combine-map") == 0 && value) {
+        options.combineMapPath = value;
+        return 2;
+    } else if (strcmp(name, "-carve") == 0 && value && i + 2 < argc) {
+        char* colon = strchr(value, ':');
+        if (colon == NULL || colon == value) {
+            return 0;
         }
-        ssize_t wb = write(fd_new, buffer, copyLength);
-        if (wb != copyLength) {
-            perror("Error while writing partition data");
-            close(fd_new);
-            free(buffer);
-            exit(EXIT_FAILURE);
+        char offset[64];
+        snprintf(offset, sizeof(offset), "%.*s", (int)(colon - value), value);
+        if (parseSize(offset, &options.carveOffset) != 0 || parseSize(colon + 1, &options.carveLength) != 0 ||
+            options.carveLength == 0) {
+            return 0;
         }
-        dataSizeLeft -= copyLength;
-        dataSizeRead += copyLength;
-        printProgressBar(dataSizeRead, partHeader->partitionSize);
+        options.carvePath = argv[i + 2];
+        return 3;
+    } else if (strcmp(name, "-warnings-json") == 0 && value) {
+        options.warningsJsonTarget = value;
+        return 2;
+    } else if (strcmp(name, "-charset") == 0 && value) {
+        if (strcmp(value, "utf16") == 0) {
+            options.charset = CHARSET_UTF16;
+        } else if (strcmp(value, "gbk") == 0) {
+            options.charset = CHARSET_GBK;
+        } else if (strcmp(value, "latin1") == 0) {
+            options.charset = CHARSET_LATIN1;
+        } else {
+            return 0;
+        }
+        return 2;
+    } else if (strcmp(name, "-name-field") == 0 && value) {
+        if (strcmp(value, "partition") == 0) {
+            options.nameField = NAME_FIELD_PARTITION;
+        } else if (strcmp(value, "file") == 0) {
+            options.nameField = NAME_FIELD_FILE;
+        } else {
+            return 0;
+        }
+        return 2;
+    } else if (strcmp(name, "-sort") == 0 && value) {
+        if (strcmp(value, "index") == 0) {
+            options.sortOrder = SORT_INDEX;
+        } else if (strcmp(value, "size") == 0) {
+            options.sortOrder = SORT_SIZE;
+        } else if (strcmp(value, "name") == 0) {
+            options.sortOrder = SORT_NAME;
+        } else if (strcmp(value, "offset") == 0) {
+            options.sortOrder = SORT_OFFSET;
+        } else {
+            return 0;
+        }
+        return 2;
+    } else if (strcmp(name, "-log-file") == 0 && value) {
+        options.logFilePath = value;
+        return 2;
+    } else if (strcmp(name, "-stats-json") == 0 && value) {
+        options.statsJsonPath = value;
+        return 2;
+    } else if (strcmp(name, "-summary-json") == 0 && value) {
+        options.summaryJsonPath = value;
+        return 2;
+    } else if (strcmp(name, "-emit-script") == 0 && value) {
+        options.scriptPath = value;
+        return 2;
+    } else if (strcmp(name, "-since") == 0 && value) {
+        options.sincePath = value;
+        return 2;
+    } else if (strcmp(name, "-only") == 0 && value) {
+        options.onlyNames = value;
+        return 2;
+    } else if (strcmp(name, "-exclude") == 0 && value) {
+        options.excludeNames = value;
+        return 2;
+    } else if (strcmp(name, "-alias-file") == 0 && value) {
+        options.aliasPath = value;
+        return 2;
+    } else if (strcmp(name, "-type") == 0 && value) {
+        if (!isValidTypeList(value)) {
+            return 0;
+        }
+        options.typeNames = value;
+        return 2;
+    } else if (strcmp(name, "-slot") == 0 && value) {
+        if (strcasecmp(value, "a") != 0 && strcasecmp(value, "b") != 0) {
+            return 0;
+        }
+        options.slot = tolower((unsigned char)value[0]);
+        return 2;
+    } else if (strcmp(name, "-extract-to-fd") == 0 && value) {
+        char* colon = strrchr(value, ':');
+        char* end;
+        if (colon == NULL || colon == value || options.fdTargetCount == MAX_FD_TARGETS) {
+            return 0;
+        }
+        long targetFd = strtol(colon + 1, &end, 10);
+        if (end == colon + 1 || *end != '\0' || targetFd < 0 || targetFd > INT32_MAX) {
+            return 0;
+        }
+        FdTarget* target = &options.fdTargets[options.fdTargetCount++];
+        snprintf(target->partitionName, sizeof(target->partitionName), "%.*s", (int)(colon - value), value);
+        target->fd = (int)targetFd;
+        return 2;
+    } else if (strcmp(name, "-stdout-partition") == 0 && value) {
+        options.stdoutPartition = value;
+        return 2;
+    } else if (strcmp(name, "-filter-cmd") == 0 && value) {
+        char* colon = strchr(value, ':');
+        if (colon == NULL || colon == value || colon[1] == '\0' ||
+            options.filterCommandCount == MAX_FILTER_COMMANDS) {
+            return 0;
+        }
+        FilterCommand* filter = &options.filterCommands[options.filterCommandCount++];
+        snprintf(filter->partitionName, sizeof(filter->partitionName), "%.*s", (int)(colon - value), value);
+        filter->command = colon + 1;
+        return 2;
+    } else if (strcmp(name, "-progress-fd") == 0 && value) {
+        char* end;
+        long progressFd = strtol(value, &end, 10);
+        if (end == value || *end != '\0' || progressFd < 0 || progressFd > INT32_MAX) {
+            return 0;
+        }
+        options.progressFd = (int)progressFd;
+        return 2;
+    } else if (strcmp(name, "-partial-extract") == 0 && value) {
+        char* lengthText = strrchr(value, ':');
+        if (lengthText == NULL || lengthText == value) {
+            return 0;
+        }
+        char* offsetText = lengthText - 1;
+        while (offsetText > value && *offsetText != ':') {
+            offsetText--;
+        }
+        if (offsetText == value) {
+            return 0;
+        }
+        char partitionName[256];
+        snprintf(partitionName, sizeof(partitionName), "%.*s", (int)(offsetText - value), value);
+        char offset[64];
+        snprintf(offset, sizeof(offset), "%.*s", (int)(lengthText - offsetText - 1), offsetText + 1);
+        if (parseSize(offset, &options.partialOffset) != 0 ||
+            parseSize(lengthText + 1, &options.partialLength) != 0 || options.partialLength == 0) {
+            return 0;
+        }
+        options.partialName = strdup(partitionName);
+        return 2;
+    } else if (strcmp(name, "-exec") == 0 && value) {
+        options.execCommand = value;
+        return 2;
+    } else if (strcmp(name, "-buffer-size") == 0 && value) {
+        uint64_t size;
+        if (parseSize(value, &size) != 0 || size == 0 || size > SIZE_MAX) {
+            return 0;
+        }
+        options.bufferSize = size;
+        return 2;
+    } else if (strcmp(name, "-max-partition-size") == 0 && value) {
+        if (parseSize(value, &options.maxPartitionSize) != 0) {
+            return 0;
+        }
+        return 2;
+    } else if (strcmp(name, "-min-size") == 0 && value) {
+        if (parseSize(value, &options.minSize) != 0) {
+            return 0;
+        }
+        return 2;
+    } else if (strcmp(name, "-max-size") == 0 && value) {
+        if (parseSize(value, &options.maxSize) != 0) {
+            return 0;
+        }
+        return 2;
+    } else if (strcmp(name, "-expect-sums") == 0 && value) {
+        options.expectSumsPath = value;
+        return 2;
+    } else if (strcmp(name, "-checksum-algo") == 0 && value) {
+        char list[256];
+        snprintf(list, sizeof(list), "%s", value);
+        options.checksumAlgorithms = 0;
+        for (char* algo = strtok(list, ","); algo != NULL; algo = strtok(NULL, ",")) {
+            ChecksumAlgorithm algorithm = checksumFromName(trimWhitespace(algo));
+            if (algorithm == CHECKSUM_COUNT) {
+                return 0;
+            }
+            options.checksumAlgorithms |= 1u << algorithm;
+        }
+        return options.checksumAlgorithms != 0 ? 2 : 0;
+    } else if (strcmp(name, "-write-buffer") == 0 && value) {
+        uint64_t size;
+        if (parseSize(value, &size) != 0 || size == 0 || size > SIZE_MAX) {
+            return 0;
+        }
+        options.writeBufferSize = size;
+        return 2;
+    } else if (strcmp(name, "-crc-offset") == 0 && value) {
+        uint64_t offset;
+        if (parseSize(value, &offset) != 0 || offset > UINT32_MAX) {
+            return 0;
+        }
+        options.crcOffset = offset;
+        return 2;
+    } else if (strcmp(name, "-crc-width") == 0 && value) {
+        if (strcmp(value, "1") != 0 && strcmp(value, "2") != 0 && strcmp(value, "4") != 0) {
+            return 0;
+        }
+        options.crcWidth = atoi(value);
+        return 2;
     }
-    printf("\n");
-    close(fd_new);
-    free(buffer);
+    return 0;
 }
 
-int main(int argc, char** argv) {
-    if (argc < 5) {
-        printUsageAndExit();
+static void recordOption(char** words, int count) {
+    RecordedOption* recorded = realloc(recordedOptions, (recordedOptionCount + 1) * sizeof(RecordedOption));
+    if (recorded == NULL) {
+        logErrno("Memory allocation failed");
+        exit(EXIT_FAILURE);
     }
+    recordedOptions = recorded;
+    recordedOptions[recordedOptionCount].words = words;
+    recordedOptions[recordedOptionCount].count = count;
+    recordedOptionCount++;
+}
 
-    if (strcmp(argv[1], "-h") == 0) {
-        printUsage();
-        exit(EXIT_SUCCESS);
-    } else if (strcmp(argv[1], "-v") == 0) {
-        printf("pacextractor version %s\n", VERSION);
-        exit(EXIT_SUCCESS);
-    } else if (strcmp(argv[1], "-e") == 0 && strcmp(argv[3], "-o") == 0) {
-        // Process the extraction
-        int fd = openFirmwareFile(argv[2]);
-        
-        struct stat st;
-        if (fstat(fd, &st) == -1) {
-            perror("Error getting file stats");
-            exit(EXIT_FAILURE);
+// Loads option defaults from ~/.pacextractor.yaml. Only flat "name: value"
+// lines are understood; a missing file is not an error.
+static void loadConfigFile(void) {
+    const char* home = getenv("HOME");
+    if (home == NULL) {
+        return;
+    }
+
+    char configPath[768];
+    snprintf(configPath, sizeof(configPath), "%s/%s", home, CONFIG_FILE_NAME);
+    FILE* file = fopen(configPath, "r");
+    if (file == NULL) {
+        return;
+    }
+
+    char line[1024];
+    int lineNumber = 0;
+    while (fgets(line, sizeof(line), file) != NULL) {
+        lineNumber++;
+        char* comment = strchr(line, '#');
+        if (comment != NULL && (comment == line || isspace((unsigned char)comment[-1]))) {
+            *comment = '\0';
         }
-        int firmwareSize = st.st_size;
-        if (firmwareSize < sizeof(PacHeader)) {
-            fprintf(stderr, "File %s is not a valid firmware\n", argv[2]);
-            close(fd);
-            exit(EXIT_FAILURE);
+        char* key = trimWhitespace(line);
+        if (*key == '\0' || strcmp(key, "---") == 0) {
+            continue;
         }
 
-        char* outputPath = argv[4];
-        createOutputDirectory(outputPath);
+        char* colon = strchr(key, ':');
+        if (colon == NULL) {
+            logError("%s:%d: expected \"name: value\"\n", configPath, lineNumber);
+            exit(EXIT_FAILURE);
+        }
+        *colon = '\0';
+        key = trimWhitespace(key);
+        char* value = trimWhitespace(colon + 1);
+        size_t valueLength = strlen(value);
+        if (valueLength >= 2 && (value[0] == '"' || value[0] == '\'') && value[valueLength - 1] == value[0]) {
+            value[valueLength - 1] = '\0';
+            value++;
+        }
 
-        PacHeader pacHeader = readPacHeader(fd);
-        
-        char firmwareName[256];
-        getString(pacHeader.firmwareName, firmwareName);
-        printf("Firmware name: %s\n", firmwareName);
+        if (strcmp(value, "false") == 0) {
+            continue;
+        }
 
-        uint32_t curPos = pacHeader.partitionsListStart;
-        PartitionHeader** partHeaders = malloc(pacHeader.partitionCount * sizeof(PartitionHeader*));
-        if (partHeaders == NULL) {
-            perror("Memory allocation failed for partition headers");
-            close(fd);
-            exit(EXIT_FAILURE);
+        char flag[256];
+        snprintf(flag, sizeof(flag), "-%s", key);
+        char* args[2] = { flag, NULL };
+        int argCount = 1;
+        if (strcmp(value, "true") != 0) {
+            args[1] = strdup(value);
+            if (args[1] == NULL) {
+                logErrno("Memory allocation failed");
+                exit(EXIT_FAILURE);
+            }
+            argCount = 2;
         }
 
-        for (int i = 0; i < pacHeader.partitionCount; i++) {
-            partHeaders[i] = readPartitionHeader(fd, &curPos);
-            
-            char partitionName[256];
-            char fileName[512];
-            getString(partHeaders[i]->partitionName, partitionName);
-            getString(partHeaders[i]->fileName, fileName);
-            printf("Partition name: %s\n\twith file name: %s\n\twith size %u\n",
-                   partitionName, fileName, partHeaders[i]->partitionSize);
+        if (parseOption(argCount, args, 0) != argCount) {
+            logError("%s:%d: invalid setting \"%s\"\n", configPath, lineNumber, key);
+            exit(EXIT_FAILURE);
         }
 
-        for (int i = 0; i < pacHeader.partitionCount; i++) {
-            extractPartition(fd, partHeaders[i], outputPath);
-            free(partHeaders[i]);
+        char** words = malloc(2 * sizeof(char*));
+        if (words == NULL || (words[0] = strdup(flag)) == NULL) {
+            logErrno("Memory allocation failed");
+            exit(EXIT_FAILURE);
         }
-        free(partHeaders);
-        close(fd);
-        
-        return EXIT_SUCCESS;
-    } else {
-        printUsageAndExit();
+        words[1] = args[1];
+        recordOption(words, argCount);
     }
+    fclose(file);
+}
 
-    return EXIT_SUCCESS;
+static void handleOpenFileError(const char* fileName) {
+    logErrno(fileName);
+    exit(EXIT_FAILURE);
+}
+
+// The firmware is a signed image that must never be altered, so it is only
+// ever opened read-only
+static int openFirmwareFile(const char* filePath) {
+    int fd = open(filePath, O_RDONLY);
+    if (fd == -1) {
+        handleOpenFileError(filePath);
+    }
+    if ((fcntl(fd, F_GETFL) & O_ACCMODE) != O_RDONLY) {
+        logError("Firmware file %s is not opened read-only\n", filePath);
+        exit(EXIT_FAILURE);
+    }
+    return fd;
+}
+
+// Sets up -direct, warning and carrying on with normal reads if the system
+// or file system can't do direct I/O
+static void openDirectInput(const char* filePath) {
+#ifdef O_DIRECT
+    directFd = open(filePath, O_RDONLY | O_DIRECT);
+    if (directFd != -1 &&
+        posix_memalign((void**)&directBuffer, DIRECT_IO_ALIGNMENT, options.bufferSize + 2 * DIRECT_IO_ALIGNMENT) != 0) {
+        close(directFd);
+        directFd = -1;
+    }
+#endif
+    if (directFd == -1) {
+        logWarning("direct-io-unsupported", NULL,
+                   "direct I/O is not supported for %s, reading through the page cache", filePath);
+    }
+}
+
+// Reads up to options.bufferSize bytes of partition data at offset, with
+// O_DIRECT under -direct. Returns the number of bytes read like pread.
+static ssize_t readPartitionData(int fd, char* buffer, size_t length, off_t offset) {
+    if (directFd == -1) {
+        return pread(fd, buffer, length, offset);
+    }
+
+    off_t start = offset & ~(off_t)(DIRECT_IO_ALIGNMENT - 1);
+    size_t skip = offset - start;
+    size_t span = (skip + length + DIRECT_IO_ALIGNMENT - 1) & ~(size_t)(DIRECT_IO_ALIGNMENT - 1);
+    ssize_t rb = pread(directFd, directBuffer, span, start);
+    if (rb <= (ssize_t)skip) {
+        return rb < 0 ? rb : 0;
+    }
+    size_t available = rb - skip;
+    size_t copied = available < length ? available : length;
+    memcpy(buffer, directBuffer + skip, copied);
+    return copied;
+}
+
+// Fails the run if the firmware file changed size or modification time
+// since it was opened, which this tool must never cause
+static void verifyFirmwareUnchanged(int fd, const struct stat* before) {
+    struct stat after;
+    if (fstat(fd, &after) == -1) {
+        logErrno("Error getting file stats");
+        exit(EXIT_FAILURE);
+    }
+    if (after.st_size != before->st_size || after.st_mtim.tv_sec != before->st_mtim.tv_sec ||
+        after.st_mtim.tv_nsec != before->st_mtim.tv_nsec) {
+        logError("Firmware file %s was modified during the run\n", options.firmwarePath);
+        exit(EXIT_FAILURE);
+    }
+}
+
+static void createOutputDirectory(const char* path) {
+    char temp[768];
+    strcpy(temp, path);
+    for (char *p = temp; *p; p++) {
+        if (*p == '/' && p != temp) {
+            *p = 0;  // Temporarily terminate the string
+            if (access(temp, F_OK) == -1) {
+                if (mkdir(temp, 0777) == -1) {
+                    logErrno("Failed to create output directory");
+                    exit(EXIT_FAILURE);
+                }
+            }
+            *p = '/';  // Restore the string
+        }
+    }
+    struct stat st;
+    if (stat(temp, &st) == 0) {
+        // Output files would otherwise fail one by one with ENOTDIR
+        if (!S_ISDIR(st.st_mode)) {
+            logError("Output path %s exists and is not a directory\n", path);
+            exit(EXIT_FAILURE);
+        }
+    } else if (mkdir(temp, 0777) == -1) {
+        logErrno("Failed to create output directory");
+        exit(EXIT_FAILURE);
+    }
+}
+
+// Creates and removes a file in the output directory, so that a read-only
+// destination is reported before the partition table is even read
+static void checkOutputWritable(const char* path) {
+    char testPath[800];
+    snprintf(testPath, sizeof(testPath), "%s/.pacextractor-XXXXXX", path);
+    int fd = mkstemp(testPath);
+    if (fd == -1) {
+        logError("Output directory %s is not writable: %s\n", path, strerror(errno));
+        exit(EXIT_FAILURE);
+    }
+    close(fd);
+    unlink(testPath);
+}
+
+static PacHeader readPacHeader(int fd) {
+    PacHeader header;
+    if (pread(fd, &header, sizeof(PacHeader), pacBase) != sizeof(PacHeader)) {
+        logErrno("Error while reading PAC header");
+        exit(EXIT_FAILURE);
+    }
+    return header;
+}
+
+// Sanity checks a PAC header against the size of the file it was read from
+// without looking any further. Returns why it isn't plausible, or NULL.
+static const char* validatePacHeader(const PacHeader* header, off_t fileSize) {
+    if (header->partitionCount < 0) {
+        return "negative partition count";
+    }
+    if (header->partitionsListStart < (int32_t)sizeof(PacHeader) || header->partitionsListStart > fileSize) {
+        return "partition table offset outside the file";
+    }
+    if ((int64_t)header->partitionCount * (int64_t)sizeof(PartitionHeader) >
+        (int64_t)fileSize - header->partitionsListStart) {
+        return "partition table doesn't fit in the file";
+    }
+    // The size field only holds the low 32 bits, which can't be checked
+    // against what's left of a file of 4 GiB or more
+    if (!options.ignoreMagic && (header->pacSize < sizeof(PacHeader) ||
+                                 (fileSize <= UINT32_MAX && header->pacSize > fileSize))) {
+        return "PAC size field doesn't fit the file";
+    }
+    return NULL;
+}
+
+// Reads the partition header at *curPos and advances past it. A header that
+// is cut off or has an impossible length is fatal, unless -skip-bad-headers
+// is set; then NULL is returned and *curPos is advanced by resyncLength, to
+// where the next header is expected. A resyncLength of 0 leaves it alone
+// for callers that stop at the bad header.
+static PartitionHeader* readPartitionHeader(int fd, uint32_t* curPos, off_t fileSize, uint32_t resyncLength) {
+    char problem[64] = "";
+    PartitionHeader* header = NULL;
+    uint32_t length;
+    if (pread(fd, &length, sizeof(length), pacBase + *curPos) != sizeof(length)) {
+        snprintf(problem, sizeof(problem), "is cut off");
+    } else if (length < sizeof(PartitionHeader) || pacBase + *curPos + length > fileSize) {
+        snprintf(problem, sizeof(problem), "has an invalid length of %u bytes", length);
+    } else {
+        header = malloc(length);
+        if (header == NULL) {
+            logErrno("Memory allocation failed");
+            exit(EXIT_FAILURE);
+        }
+        if (pread(fd, header, length, pacBase + *curPos) != length) {
+            free(header);
+            header = NULL;
+            snprintf(problem, sizeof(problem), "is cut off");
+        }
+    }
+
+    if (header != NULL) {
+        *curPos += length;
+    } else if (options.skipBadHeaders && resyncLength > 0) {
+        logWarning("bad-partition-header", NULL,
+                   "partition header at 0x%x %s, skipping it and resuming %u bytes further", *curPos, problem,
+                   resyncLength);
+        *curPos += resyncLength;
+    } else if (options.skipBadHeaders) {
+        logWarning("bad-partition-header", NULL, "partition header at 0x%x %s", *curPos, problem);
+    } else {
+        logError("Partition header at 0x%x %s\n", *curPos, problem);
+        exit(EXIT_FAILURE);
+    }
+    return header;
+}
+
+// A way the headers could be laid out, tried by -probe. The first one is
+// what the rest of the tool parses.
+typedef struct {
+    int bigEndian;
+    // The partition table right after the PAC header instead of at
+    // partitionsListStart
+    int tableAfterHeader;
+    // Partition headers sizeof(PartitionHeader) apart instead of their
+    // length field apart
+    int fixedStride;
+} ProbeLayout;
+
+static const ProbeLayout probeLayoutCandidates[] = {
+    {0, 0, 0}, {0, 0, 1}, {0, 1, 0}, {0, 1, 1},
+    {1, 0, 0}, {1, 0, 1}, {1, 1, 0}, {1, 1, 1},
+};
+
+// Partition headers looked at per layout, so that a garbage count doesn't
+// take forever
+#define PROBE_MAX_PARTITIONS 4096
+
+typedef struct {
+    const ProbeLayout* layout;
+    int score;
+    int32_t partitionCount;
+    uint32_t tableStart;
+} ProbeResult;
+
+typedef struct {
+    uint64_t start;
+    uint64_t end;
+} ProbeRange;
+
+static uint32_t probeRead32(const unsigned char* bytes, int bigEndian) {
+    if (bigEndian) {
+        return (uint32_t)bytes[0] << 24 | (uint32_t)bytes[1] << 16 | (uint32_t)bytes[2] << 8 | bytes[3];
+    }
+    return (uint32_t)bytes[3] << 24 | (uint32_t)bytes[2] << 16 | (uint32_t)bytes[1] << 8 | bytes[0];
+}
+
+static int compareProbeRanges(const void* a, const void* b) {
+    const ProbeRange* ra = a;
+    const ProbeRange* rb = b;
+    return ra->start < rb->start ? -1 : ra->start > rb->start;
+}
+
+// Higher scores first, otherwise in candidate order
+static int compareProbeResults(const void* a, const void* b) {
+    const ProbeResult* ra = a;
+    const ProbeResult* rb = b;
+    if (ra->score != rb->score) {
+        return rb->score - ra->score;
+    }
+    return ra->layout < rb->layout ? -1 : ra->layout > rb->layout;
+}
+
+// Scores a layout out of 100: 10 for a PAC size field matching the file,
+// 10 for a table start inside it, 20 for a partition count that fits, and
+// 20 each for the share of partition headers that can be read, of data
+// ranges inside the file, and of data ranges overlapping nothing else
+static ProbeResult probeLayout(int fd, off_t fileSize, const unsigned char* pacBytes, const ProbeLayout* layout) {
+    ProbeResult result = {layout, 0, 0, 0};
+    uint64_t available = fileSize - pacBase;
+    uint32_t pacSize = probeRead32(pacBytes + offsetof(PacHeader, pacSize), layout->bigEndian);
+    result.partitionCount = (int32_t)probeRead32(pacBytes + offsetof(PacHeader, partitionCount), layout->bigEndian);
+    result.tableStart = layout->tableAfterHeader
+                            ? sizeof(PacHeader)
+                            : probeRead32(pacBytes + offsetof(PacHeader, partitionsListStart), layout->bigEndian);
+
+    if (pacSize == (uint32_t)available) {
+        result.score += 10;
+    }
+    if (result.tableStart < sizeof(PacHeader) || result.tableStart > available) {
+        return result;
+    }
+    result.score += 10;
+    if (result.partitionCount <= 0 ||
+        (uint64_t)result.partitionCount * sizeof(PartitionHeader) > available - result.tableStart) {
+        return result;
+    }
+    result.score += 20;
+
+    int checked = result.partitionCount < PROBE_MAX_PARTITIONS ? result.partitionCount : PROBE_MAX_PARTITIONS;
+    ProbeRange* ranges = malloc(checked * sizeof(ProbeRange));
+    if (ranges == NULL) {
+        logErrno("Memory allocation failed");
+        exit(EXIT_FAILURE);
+    }
+    int headersRead = 0;
+    int rangeCount = 0;
+    int emptyCount = 0;
+    uint64_t pos = result.tableStart;
+    for (int i = 0; i < checked; i++) {
+        unsigned char partBytes[sizeof(PartitionHeader)];
+        if (pos + sizeof(partBytes) > available ||
+            pread(fd, partBytes, sizeof(partBytes), pacBase + pos) != sizeof(partBytes)) {
+            break;
+        }
+        uint32_t length = probeRead32(partBytes + offsetof(PartitionHeader, length), layout->bigEndian);
+        if (!layout->fixedStride && (length < sizeof(PartitionHeader) || pos + length > available)) {
+            break;
+        }
+        headersRead++;
+        pos += layout->fixedStride ? sizeof(PartitionHeader) : length;
+
+        uint64_t size = probeRead32(partBytes + offsetof(PartitionHeader, partitionSize), layout->bigEndian);
+        uint64_t start = probeRead32(partBytes + offsetof(PartitionHeader, partitionAddrInPac), layout->bigEndian);
+        if (size == 0) {
+            emptyCount++;
+        } else if (start + size <= available) {
+            ranges[rangeCount].start = start;
+            ranges[rangeCount].end = start + size;
+            rangeCount++;
+        }
+    }
+
+    // Data may overlap neither the headers nor other data
+    int separateCount = 0;
+    uint64_t end = pos;
+    qsort(ranges, rangeCount, sizeof(ProbeRange), compareProbeRanges);
+    for (int i = 0; i < rangeCount; i++) {
+        if (ranges[i].start >= end) {
+            separateCount++;
+        }
+        if (ranges[i].end > end) {
+            end = ranges[i].end;
+        }
+    }
+    free(ranges);
+
+    result.score += 20 * headersRead / checked;
+    result.score += 20 * (rangeCount + emptyCount) / checked;
+    result.score += 20 * (separateCount + emptyCount) / checked;
+    return result;
+}
+
+// Parses the headers under each candidate layout and prints them ranked by
+// score, as an aid to working out new PAC variants
+static void probeLayouts(int fd, off_t fileSize) {
+    unsigned char pacBytes[sizeof(PacHeader)];
+    if (pread(fd, pacBytes, sizeof(pacBytes), pacBase) != sizeof(pacBytes)) {
+        logErrno("Error while reading PAC header");
+        exit(EXIT_FAILURE);
+    }
+
+    ProbeResult results[ARRAY_LENGTH(probeLayoutCandidates)];
+    for (size_t i = 0; i < ARRAY_LENGTH(probeLayoutCandidates); i++) {
+        results[i] = probeLayout(fd, fileSize, pacBytes, &probeLayoutCandidates[i]);
+    }
+    qsort(results, ARRAY_LENGTH(results), sizeof(ProbeResult), compareProbeResults);
+
+    printf("Score  Endian  Table at             Header stride  Partitions  Table offset\n");
+    for (size_t i = 0; i < ARRAY_LENGTH(results); i++) {
+        const ProbeLayout* layout = results[i].layout;
+        printf("%5d%s %-7s %-20s %-14s %10d  0x%x\n", results[i].score,
+               layout == &probeLayoutCandidates[0] ? "*" : " ", layout->bigEndian ? "big" : "little",
+               layout->tableAfterHeader ? "end of PAC header" : "partitionsListStart",
+               layout->fixedStride ? "fixed" : "length field", results[i].partitionCount, results[i].tableStart);
+    }
+    printf("* is the layout used for extraction\n");
+}
+
+static const MagicSignature* detectSignature(int fd, const PartitionHeader* partHeader) {
+    unsigned char peek[MAGIC_PEEK_SIZE];
+    size_t peekLength = partHeader->partitionSize < sizeof(peek) ? partHeader->partitionSize : sizeof(peek);
+    ssize_t rb = pread(fd, peek, peekLength, pacBase + partHeader->partitionAddrInPac);
+    if (rb < 0) {
+        return NULL;
+    }
+
+    for (size_t i = 0; i < sizeof(magicSignatures) / sizeof(magicSignatures[0]); i++) {
+        const MagicSignature* sig = &magicSignatures[i];
+        if (sig->offset + sig->magicLength <= (size_t)rb &&
+            memcmp(peek + sig->offset, sig->magic, sig->magicLength) == 0) {
+            return sig;
+        }
+    }
+    return NULL;
+}
+
+static int hasExtension(const char* fileName) {
+    const char* base = strrchr(fileName, '/');
+    base = base ? base + 1 : fileName;
+    const char* dot = strrchr(base, '.');
+    return dot != NULL && dot != base && dot[1] != '\0';
+}
+
+static double monotonicSeconds(void) {
+    struct timespec ts;
+    clock_gettime(CLOCK_MONOTONIC, &ts);
+    return ts.tv_sec + ts.tv_nsec / 1e9;
+}
+
+// Folds the throughput since the last sample into an exponential moving
+// average so that the ETA doesn't jump around on every buffer
+static void updateProgressRate(ProgressRate* rate, uint32_t completed) {
+    const double minInterval = 0.2; // seconds
+    const double smoothing = 0.3;
+
+    double now = monotonicSeconds();
+    double elapsed = now - rate->lastTime;
+    if (elapsed < minInterval) {
+        return;
+    }
+
+    double sample = (completed - rate->lastCompleted) / elapsed;
+    rate->rate = rate->rate == 0 ? sample : smoothing * sample + (1 - smoothing) * rate->rate;
+    rate->lastTime = now;
+    rate->lastCompleted = completed;
+}
+
+static void printProgressBar(uint32_t completed, uint32_t total, const ProgressRate* rate) {
+    const int barWidth = 50;
+    float progress = (float)completed / total;
+    int pos = barWidth * progress;
+
+    // Determine color based on progress
+    const char* color;
+    if (progress < 0.5) {
+        color = "\033[31m"; // Red
+    } else if (progress < 0.8) {
+        color = "\033[33m"; // Yellow
+    } else {
+        color = "\033[32m"; // Green
+    }
+    const char* reset = "\033[0m"; // Reset color
+
+    printf("\r[%s", color);
+    for (int i = 0; i < barWidth; ++i) {
+        if (i < pos) printf("=");
+        else if (i == pos) printf(">");
+        else printf(" ");
+    }
+    printf("]%s %.2f%%", reset, progress * 100.0);
+
+    if (rate->rate > 0) {
+        unsigned long eta = (unsigned long)((total - completed) / rate->rate + 0.5);
+        printf(" %.1f MB/s ETA %lu:%02lu  ", rate->rate / 1e6, eta / 60, eta % 60);
+    }
+    fflush(stdout);
+}
+
+static uint32_t crc32Update(uint32_t crc, const void* data, size_t length) {
+    static uint32_t table[256];
+    if (table[1] == 0) {
+        for (uint32_t i = 0; i < 256; i++) {
+            uint32_t c = i;
+            for (int k = 0; k < 8; k++) {
+                c = (c & 1) ? 0xEDB88320 ^ (c >> 1) : c >> 1;
+            }
+            table[i] = c;
+        }
+    }
+
+    const unsigned char* bytes = data;
+    crc = ~crc;
+    while (length--) {
+        crc = table[(crc ^ *bytes++) & 0xFF] ^ (crc >> 8);
+    }
+    return ~crc;
+}
+
+// Compares the CRC32 computed over a partition's data with the little-endian
+// value stored at the configured -crc-offset/-crc-width in its header. Only
+// the low bytes of the CRC are compared when the field is narrower.
+static void reportCrcCheck(const PartitionHeader* partHeader, const char* fileName, uint32_t crc) {
+    if (options.crcOffset + options.crcWidth > partHeader->length) {
+        logInfo("CRC32 of %s: 0x%08x (offset %zu is outside the %u byte partition header)\n",
+                fileName, crc, options.crcOffset, partHeader->length);
+        return;
+    }
+
+    const unsigned char* field = (const unsigned char*)partHeader + options.crcOffset;
+    uint32_t stored = 0;
+    for (size_t i = 0; i < options.crcWidth; i++) {
+        stored |= (uint32_t)field[i] << (8 * i);
+    }
+    uint32_t mask = options.crcWidth == 4 ? 0xFFFFFFFF : (1u << (8 * options.crcWidth)) - 1;
+
+    logInfo("CRC32 of %s: 0x%08x, stored 0x%0*x: %s\n", fileName, crc, (int)options.crcWidth * 2, stored,
+            (crc & mask) == stored ? "match" : "MISMATCH");
+}
+
+// Compares the file size with what the headers account for: the PAC header,
+// the partition table and the data of every partition. More bytes than that
+// suggests appended data, fewer suggests a truncated download.
+static void printSizeDiscrepancy(const PacHeader* pacHeader, PartitionHeader** partHeaders, off_t firmwareSize) {
+    int64_t expected = pacHeader->partitionsListStart;
+    for (int i = 0; i < pacHeader->partitionCount; i++) {
+        expected += partHeaders[i]->length;
+        expected += partHeaders[i]->partitionSize;
+    }
+
+    int64_t discrepancy = (int64_t)firmwareSize - expected;
+    logInfo("File size: %lld bytes, accounted for by headers: %lld bytes\n",
+            (long long)firmwareSize, (long long)expected);
+    logInfo("Size discrepancy: %+lld bytes%s\n", (long long)discrepancy,
+            discrepancy > 0 ? " (appended data?)" : discrepancy < 0 ? " (truncated file?)" : "");
+}
+
+static int headerIndex(int index) {
+    return headerIndices != NULL ? headerIndices[index] : index;
+}
+
+// Written first in every JSON document, so consumers can tell which layout
+// they are reading
+static void writeJsonVersionFields(FILE* file) {
+    fprintf(file, "  \"schema_version\": %d,\n", JSON_SCHEMA_VERSION);
+    fprintf(file, "  \"tool_version\": \"%s\",\n", VERSION);
+}
+
+static double bytesPerSecond(uint64_t bytes, double seconds) {
+    return seconds > 0 ? bytes / seconds : 0.0;
+}
+
+// Formats a byte count with a binary unit, e.g. "33.5 MiB"
+static void formatSize(uint64_t bytes, char* text, size_t size) {
+    static const char* const units[] = { "B", "KiB", "MiB", "GiB", "TiB" };
+    double value = bytes;
+    size_t unit = 0;
+    while (value >= 1024 && unit + 1 < ARRAY_LENGTH(units)) {
+        value /= 1024;
+        unit++;
+    }
+    if (unit == 0) {
+        snprintf(text, size, "%llu B", (unsigned long long)bytes);
+    } else {
+        snprintf(text, size, "%.1f %s", value, units[unit]);
+    }
+}
+
+static void writeJsonIntArray(FILE* file, const int32_t* values, int count) {
+    fputc('[', file);
+    for (int i = 0; i < count; i++) {
+        fprintf(file, "%s%d", i == 0 ? "" : ", ", values[i]);
+    }
+    fputc(']', file);
+}
+
+static void writeJsonInt16Array(FILE* file, const int16_t* values, int count) {
+    fputc('[', file);
+    for (int i = 0; i < count; i++) {
+        fprintf(file, "%s%d", i == 0 ? "" : ", ", values[i]);
+    }
+    fputc(']', file);
+}
+
+// Opens a JSON file to write the document of the PAC at pacBase. Under
+// -multi the file holds an array with one document per PAC, which stays
+// valid after each one: a later PAC's document replaces the closing bracket.
+// Returns NULL with errno set on failure.
+static FILE* openJsonDocument(const char* path) {
+    if (!options.multi) {
+        return fopen(path, "w");
+    }
+    if (pacBase == 0) {
+        FILE* file = fopen(path, "w");
+        if (file != NULL) {
+            fputs("[\n", file);
+        }
+        return file;
+    }
+
+    // The previous document ends with "}\n]\n"
+    FILE* file = fopen(path, "r+");
+    if (file != NULL && fseek(file, -3, SEEK_END) != 0) {
+        fclose(file);
+        return NULL;
+    }
+    if (file != NULL) {
+        fputs(",\n", file);
+    }
+    return file;
+}
+
+// Ends the document of openJsonDocument and closes the file. Returns 0 on
+// success like fclose.
+static int closeJsonDocument(FILE* file) {
+    if (options.multi) {
+        fputs("]\n", file);
+    }
+    return fclose(file);
+}
+
+// Written after the version fields under -multi, to tell the documents of
+// the PACs apart
+static void writeJsonPacOffset(FILE* file) {
+    if (options.multi) {
+        fprintf(file, "  \"pac_offset\": %lld,\n", (long long)pacBase);
+    }
+}
+
+// Writes every field of the PAC header and the partition headers, including
+// the ones whose meaning is unknown, with one partition per line
+static void writeLayoutJson(const char* path, const PacHeader* pacHeader, PartitionHeader** partHeaders) {
+    FILE* file = openJsonDocument(path);
+    if (file == NULL) {
+        logErrno("Error creating layout file");
+        exit(EXIT_FAILURE);
+    }
+
+    char text[512];
+    fprintf(file, "{\n");
+    writeJsonVersionFields(file);
+    writeJsonPacOffset(file);
+    fprintf(file, "  \"pac_header\": {\n");
+    decodeUtf16(pacHeader->version, ARRAY_LENGTH(pacHeader->version), text, sizeof(text));
+    fprintf(file, "    \"version\": ");
+    writeJsonString(file, text);
+    fprintf(file, ",\n    \"pac_size\": %u,\n", pacHeader->pacSize);
+    getString(pacHeader->productName, ARRAY_LENGTH(pacHeader->productName), text, sizeof(text));
+    fprintf(file, "    \"product_name\": ");
+    writeJsonString(file, text);
+    getString(pacHeader->firmwareName, ARRAY_LENGTH(pacHeader->firmwareName), text, sizeof(text));
+    fprintf(file, ",\n    \"firmware_name\": ");
+    writeJsonString(file, text);
+    fprintf(file, ",\n    \"partition_count\": %d,\n", pacHeader->partitionCount);
+    fprintf(file, "    \"partitions_list_start\": %d,\n", pacHeader->partitionsListStart);
+    fprintf(file, "    \"some_int_fields1\": ");
+    writeJsonIntArray(file, pacHeader->someIntFields1, 5);
+    getString(pacHeader->productName2, ARRAY_LENGTH(pacHeader->productName2), text, sizeof(text));
+    fprintf(file, ",\n    \"product_name2\": ");
+    writeJsonString(file, text);
+    fprintf(file, ",\n    \"some_int_fields2\": ");
+    writeJsonInt16Array(file, pacHeader->someIntFields2, 6);
+    fprintf(file, ",\n    \"some_int_fields3\": ");
+    writeJsonInt16Array(file, pacHeader->someIntFields3, 2);
+    fprintf(file, "\n  },\n  \"partitions\": [");
+
+    for (int i = 0; i < pacHeader->partitionCount; i++) {
+        const PartitionHeader* partHeader = partHeaders[i];
+        fprintf(file, "%s\n    {\"length\": %u, \"partition_name\": ", i == 0 ? "" : ",", partHeader->length);
+        getPartitionName(partHeader, text, sizeof(text));
+        writeJsonString(file, text);
+        fprintf(file, ", \"file_name\": ");
+        getFileName(partHeader, text, sizeof(text));
+        writeJsonString(file, text);
+        fprintf(file, ", \"partition_size\": %u, \"some_fields1\": ", partHeader->partitionSize);
+        writeJsonIntArray(file, partHeader->someFields1, 2);
+        fprintf(file, ", \"partition_addr_in_pac\": %u, \"some_fields2\": ", partHeader->partitionAddrInPac);
+        writeJsonIntArray(file, partHeader->someFields2, 3);
+        fprintf(file, ", \"data_array\": ");
+        int dataCount = partHeader->length > sizeof(PartitionHeader)
+                        ? (partHeader->length - sizeof(PartitionHeader)) / sizeof(int32_t) : 0;
+        writeJsonIntArray(file, partHeader->dataArray, dataCount);
+        fputc('}', file);
+    }
+    fprintf(file, "%s]\n}\n", pacHeader->partitionCount > 0 ? "\n  " : "");
+
+    if (closeJsonDocument(file) != 0) {
+        logErrno("Error writing layout file");
+        exit(EXIT_FAILURE);
+    }
+}
+
+static void writeCsvField(FILE* file, const char* text) {
+    if (strpbrk(text, ",\"\r\n") == NULL) {
+        fputs(text, file);
+        return;
+    }
+    fputc('"', file);
+    for (; *text; text++) {
+        if (*text == '"') {
+            fputc('"', file);
+        }
+        fputc(*text, file);
+    }
+    fputc('"', file);
+}
+
+// Writes where the data of each partition lies in the file, for carving
+// tools. The PACs after the first one of a -multi dump are appended.
+static void writeOffsetsCsv(const char* path, const PacHeader* pacHeader, PartitionHeader** partHeaders) {
+    FILE* file = fopen(path, pacBase == 0 ? "w" : "a");
+    if (file == NULL) {
+        logErrno("Error creating offsets file");
+        exit(EXIT_FAILURE);
+    }
+
+    if (pacBase == 0) {
+        fprintf(file, "name,offset,size\n");
+    }
+    for (int i = 0; i < pacHeader->partitionCount; i++) {
+        char partitionName[256];
+        getPartitionName(partHeaders[i], partitionName, sizeof(partitionName));
+        // Empty partitions have no data, and usually an offset of 0
+        uint64_t offset = partHeaders[i]->partitionAddrInPac;
+        if (partHeaders[i]->partitionSize > 0) {
+            offset += pacBase;
+        }
+        writeCsvField(file, partitionName);
+        fprintf(file, ",%llu,%u\n", (unsigned long long)offset, partHeaders[i]->partitionSize);
+    }
+
+    if (fclose(file) != 0) {
+        logErrno("Error writing offsets file");
+        exit(EXIT_FAILURE);
+    }
+}
+
+// Writes the -jsonl record of one partition and flushes it, so consumers
+// see each partition as soon as its header has been read. This only saves
+// them waiting: processPac keeps every header for extraction regardless.
+static void writePartitionJsonLine(FILE* file, int index, const PartitionHeader* partHeader) {
+    char text[512];
+    fprintf(file, "{\"schema_version\": %d, \"tool_version\": \"%s\", \"index\": %d, \"partition_name\": ",
+            JSON_SCHEMA_VERSION, VERSION, index);
+    getPartitionName(partHeader, text, sizeof(text));
+    writeJsonString(file, text);
+    fprintf(file, ", \"file_name\": ");
+    getFileName(partHeader, text, sizeof(text));
+    writeJsonString(file, text);
+    fprintf(file, ", \"partition_size\": %u, \"partition_addr_in_pac\": %u}\n", partHeader->partitionSize,
+            partHeader->partitionAddrInPac);
+    fflush(file);
+}
+
+static void writeStatsJson(const char* path, const PartitionStats* stats, int count, double wallClockSeconds) {
+    FILE* file = openJsonDocument(path);
+    if (file == NULL) {
+        logErrno("Error creating stats file");
+        exit(EXIT_FAILURE);
+    }
+
+    uint64_t totalBytes = 0;
+    double totalSeconds = 0;
+    fprintf(file, "{\n");
+    writeJsonVersionFields(file);
+    writeJsonPacOffset(file);
+    fprintf(file, "  \"partitions\": [");
+    for (int i = 0; i < count; i++) {
+        fprintf(file, "%s\n    {\"partition\": ", i == 0 ? "" : ",");
+        writeJsonString(file, stats[i].partitionName);
+        fprintf(file, ", \"file\": ");
+        writeJsonString(file, stats[i].fileName);
+        fprintf(file, ", \"bytes\": %u, \"seconds\": %.6f, \"bytes_per_second\": %.0f}",
+                stats[i].bytes, stats[i].seconds, bytesPerSecond(stats[i].bytes, stats[i].seconds));
+        totalBytes += stats[i].bytes;
+        totalSeconds += stats[i].seconds;
+    }
+    fprintf(file, "%s],\n", count > 0 ? "\n  " : "");
+    fprintf(file, "  \"total_bytes\": %llu,\n", (unsigned long long)totalBytes);
+    fprintf(file, "  \"extraction_seconds\": %.6f,\n", totalSeconds);
+    fprintf(file, "  \"wall_clock_seconds\": %.6f,\n", wallClockSeconds);
+    fprintf(file, "  \"bytes_per_second\": %.0f\n}\n", bytesPerSecond(totalBytes, wallClockSeconds));
+
+    if (closeJsonDocument(file) != 0) {
+        logErrno("Error writing stats file");
+        exit(EXIT_FAILURE);
+    }
+}
+
+// The members of a JSON object, each already rendered, so that -canonical
+// can write them sorted by key and everything else in the order they were
+// added. A partition of -summary-json has the most, at 15.
+#define MAX_JSON_MEMBERS 24
+
+typedef struct {
+    const char* key;
+    char* value;
+} JsonMember;
+
+typedef struct {
+    JsonMember members[MAX_JSON_MEMBERS];
+    int count;
+} JsonObject;
+
+// Takes ownership of value
+static void addJsonMemberText(JsonObject* object, const char* key, char* value) {
+    if (value == NULL) {
+        logErrno("Memory allocation failed");
+        exit(EXIT_FAILURE);
+    }
+    object->members[object->count].key = key;
+    object->members[object->count].value = value;
+    object->count++;
+}
+
+static void addJsonMember(JsonObject* object, const char* key, const char* format, ...) {
+    char* value;
+    va_list args;
+    va_start(args, format);
+    if (vasprintf(&value, format, args) == -1) {
+        value = NULL;
+    }
+    va_end(args);
+    addJsonMemberText(object, key, value);
+}
+
+static void addJsonStringMember(JsonObject* object, const char* key, const char* text) {
+    char* value = NULL;
+    size_t length;
+    FILE* stream = open_memstream(&value, &length);
+    if (stream == NULL) {
+        logErrno("Memory allocation failed");
+        exit(EXIT_FAILURE);
+    }
+    writeJsonString(stream, text);
+    fclose(stream);
+    addJsonMemberText(object, key, value);
+}
+
+static int compareJsonMembers(const void* a, const void* b) {
+    return strcmp(((const JsonMember*)a)->key, ((const JsonMember*)b)->key);
+}
+
+// Writes the object on one line, or with one member per line, and empties
+// it for reuse
+static void writeJsonObject(FILE* file, JsonObject* object, int multiline) {
+    if (options.canonical) {
+        qsort(object->members, object->count, sizeof(JsonMember), compareJsonMembers);
+    }
+    const char* separator = multiline ? ",\n  " : ", ";
+    fputc('{', file);
+    for (int i = 0; i < object->count; i++) {
+        fprintf(file, "%s\"%s\": %s", i == 0 ? (multiline ? "\n  " : "") : separator, object->members[i].key,
+                object->members[i].value);
+        free(object->members[i].value);
+    }
+    fputs(multiline ? "\n}" : "}", file);
+    object->count = 0;
+}
+
+// Writes everything known about a run to one JSON document: the header
+// fields of each partition, what happened to it, its checksums and timing.
+// Under -canonical the keys are sorted and the timings, which differ between
+// runs, are left out.
+static void writeSummaryJson(const char* path, const char* firmwareName, const char* outputPath,
+                             const PartitionStats* stats, int count, int failedPartitions, int checksumMismatches,
+                             double wallClockSeconds) {
+    FILE* file = openJsonDocument(path);
+    if (file == NULL) {
+        logErrno("Error creating summary file");
+        exit(EXIT_FAILURE);
+    }
+
+    char* partitions = NULL;
+    size_t partitionsLength;
+    FILE* stream = open_memstream(&partitions, &partitionsLength);
+    if (stream == NULL) {
+        logErrno("Memory allocation failed");
+        exit(EXIT_FAILURE);
+    }
+    JsonObject object = {0};
+    uint64_t totalBytes = 0;
+    fputc('[', stream);
+    for (int i = 0; i < count; i++) {
+        const PartitionStats* entry = &stats[i];
+        const char* status = "extracted";
+        if (entry->skipReason != NULL) {
+            status = "skipped";
+        } else if (entry->hookFailed) {
+            status = "failed";
+        } else if (entry->partitionSize == 0) {
+            status = "empty";
+        }
+        addJsonMember(&object, "index", "%d", headerIndex(i));
+        addJsonStringMember(&object, "partition_name", entry->partitionName);
+        addJsonStringMember(&object, "file_name", entry->fileName);
+        addJsonMember(&object, "partition_size", "%u", entry->partitionSize);
+        addJsonMember(&object, "partition_addr_in_pac", "%u", entry->partitionAddrInPac);
+        addJsonMember(&object, "status", "\"%s\"", status);
+        if (entry->skipReason != NULL) {
+            addJsonStringMember(&object, "skip_reason", entry->skipReason);
+        }
+        if (entry->outputFileName[0] != '\0') {
+            addJsonStringMember(&object, "output_file", entry->outputFileName);
+        }
+        if (entry->clampedBytes > 0) {
+            addJsonMember(&object, "clamped_bytes", "%u", entry->clampedBytes);
+        }
+        addJsonMember(&object, "bytes", "%u", entry->bytes);
+        if (!options.canonical) {
+            addJsonMember(&object, "seconds", "%.6f", entry->seconds);
+        }
+        for (int algo = 0; algo < CHECKSUM_COUNT; algo++) {
+            if (entry->checksums[algo][0] != '\0') {
+                addJsonMember(&object, checksumName(algo), "\"%s\"", entry->checksums[algo]);
+            }
+        }
+        if (entry->expectedSum != NULL) {
+            addJsonMember(&object, "expected_sum", "\"%s\"", entry->expectedSum);
+        }
+        fprintf(stream, "%s\n    ", i == 0 ? "" : ",");
+        writeJsonObject(stream, &object, 0);
+        totalBytes += entry->bytes;
+    }
+    fprintf(stream, "%s]", count > 0 ? "\n  " : "");
+    fclose(stream);
+
+    addJsonMember(&object, "schema_version", "%d", JSON_SCHEMA_VERSION);
+    addJsonMember(&object, "tool_version", "\"%s\"", VERSION);
+    if (options.multi) {
+        addJsonMember(&object, "pac_offset", "%lld", (long long)pacBase);
+    }
+    addJsonStringMember(&object, "firmware", options.firmwarePath);
+    addJsonStringMember(&object, "firmware_name", firmwareName);
+    addJsonStringMember(&object, "output_path", outputPath);
+    addJsonMemberText(&object, "partitions", partitions);
+    addJsonMember(&object, "total_bytes", "%llu", (unsigned long long)totalBytes);
+    if (!options.canonical) {
+        addJsonMember(&object, "wall_clock_seconds", "%.6f", wallClockSeconds);
+    }
+    addJsonMember(&object, "failed_partitions", "%d", failedPartitions);
+    addJsonMember(&object, "checksum_mismatches", "%d", checksumMismatches);
+    writeJsonObject(file, &object, 1);
+    fputc('\n', file);
+
+    if (closeJsonDocument(file) != 0) {
+        logErrno("Error writing summary file");
+        exit(EXIT_FAILURE);
+    }
+}
+
+// Returns the format version from the header unless -force-version is set
+static void getFormatVersion(const PacHeader* pacHeader, char* version, size_t size) {
+    if (options.forceVersion != NULL) {
+        snprintf(version, size, "%s", options.forceVersion);
+        return;
+    }
+    char headerVersion[256];
+    // The version is plain ASCII in UTF-16 whatever -charset says
+    decodeUtf16(pacHeader->version, ARRAY_LENGTH(pacHeader->version), headerVersion, sizeof(headerVersion));
+    snprintf(version, size, "%s", headerVersion);
+}
+
+static int isKnownFormatVersion(const char* version) {
+    for (size_t i = 0; i < sizeof(knownFormatVersions) / sizeof(knownFormatVersions[0]); i++) {
+        if (strcmp(version, knownFormatVersions[i]) == 0) {
+            return 1;
+        }
+    }
+    return 0;
+}
+
+// Returns the index of the first nonzero unit after the terminator of a
+// fixed-size name array, or -1 if the array is properly NUL-padded
+static int findNonzeroPadding(const int16_t* name, int length) {
+    int i = 0;
+    while (i < length && name[i] != 0) {
+        i++;
+    }
+    for (; i < length; i++) {
+        if (name[i] != 0) {
+            return i;
+        }
+    }
+    return -1;
+}
+
+// Streams the whole firmware file through the -checksum-algo digests
+static void printFirmwareChecksums(int fd, const char* firmwarePath) {
+    ChecksumContext checksums[CHECKSUM_COUNT];
+    for (int algo = 0; algo < CHECKSUM_COUNT; algo++) {
+        checksumInit(&checksums[algo], algo);
+    }
+
+    char* buffer = malloc(options.bufferSize);
+    if (buffer == NULL) {
+        logErrno("Memory allocation failed");
+        exit(EXIT_FAILURE);
+    }
+
+    off_t offset = 0;
+    ssize_t rb;
+    while ((rb = pread(fd, buffer, options.bufferSize, offset)) > 0) {
+        for (int algo = 0; algo < CHECKSUM_COUNT; algo++) {
+            if (options.checksumAlgorithms & (1u << algo)) {
+                checksumUpdate(&checksums[algo], buffer, rb);
+            }
+        }
+        offset += rb;
+    }
+    free(buffer);
+    if (rb < 0) {
+        logErrno("Error while reading firmware file");
+        exit(EXIT_FAILURE);
+    }
+
+    for (int algo = 0; algo < CHECKSUM_COUNT; algo++) {
+        if (options.checksumAlgorithms & (1u << algo)) {
+            char hex[2 * CHECKSUM_MAX_DIGEST_LENGTH + 1];
+            checksumFinalHex(&checksums[algo], hex);
+            logInfo("%s of %s: %s\n", checksumName(algo), firmwarePath, hex);
+        }
+    }
+}
+
+// Compares partition names the way every selection option does: ignoring
+// case and surrounding whitespace, which vendors are inconsistent about
+static int namesMatch(const char* partitionName, const char* name) {
+    const char* trimmed = partitionName;
+    while (isspace((unsigned char)*trimmed)) {
+        trimmed++;
+    }
+    while (isspace((unsigned char)*name)) {
+        name++;
+    }
+    size_t length = strlen(trimmed);
+    while (length > 0 && isspace((unsigned char)trimmed[length - 1])) {
+        length--;
+    }
+    size_t nameLength = strlen(name);
+    while (nameLength > 0 && isspace((unsigned char)name[nameLength - 1])) {
+        nameLength--;
+    }
+    return length == nameLength && strncasecmp(trimmed, name, length) == 0;
+}
+
+// File names are compared exactly, as a case-sensitive file system would,
+// unless -lowercase-names is going to fold them together
+static int fileNamesMatch(const char* fileName, const char* other) {
+    return options.lowercaseNames ? strcasecmp(fileName, other) == 0 : strcmp(fileName, other) == 0;
+}
+
+// Warns about every name shared by more than one partition, listing the
+// indices of the partitions using it. Partition names are compared with
+// namesMatch, like selections compare them, so that e.g. -only doesn't pick
+// up a second partition unannounced. Returns the number of such names.
+static int reportDuplicateNames(PartitionHeader** partHeaders, int count,
+                                void (*getName)(const PartitionHeader*, char*, size_t),
+                                int (*match)(const char*, const char*), const char* kind) {
+    int duplicates = 0;
+    char name[1024];
+    char other[1024];
+    for (int i = 0; i < count; i++) {
+        getName(partHeaders[i], name, sizeof(name));
+        if (*name == '\0') {
+            continue;
+        }
+
+        // Only report a name at its first use
+        int seenBefore = 0;
+        for (int j = 0; j < i && !seenBefore; j++) {
+            getName(partHeaders[j], other, sizeof(other));
+            seenBefore = match(name, other);
+        }
+        if (seenBefore) {
+            continue;
+        }
+
+        char indices[256] = "";
+        int uses = 0;
+        for (int j = i; j < count; j++) {
+            getName(partHeaders[j], other, sizeof(other));
+            if (match(name, other)) {
+                size_t used = strlen(indices);
+                snprintf(indices + used, sizeof(indices) - used, "%s%d", uses == 0 ? "" : ", ", headerIndex(j));
+                uses++;
+            }
+        }
+        if (uses > 1) {
+            // Attributed to the first partition using the name
+            char partitionName[256];
+            getPartitionName(partHeaders[i], partitionName, sizeof(partitionName));
+            logWarning("duplicate-name", partitionName, "%s \"%s\" is used by partitions %s", kind, name, indices);
+            duplicates++;
+        }
+    }
+    return duplicates;
+}
+
+// Flags partitions whose data lies in the PAC header or the partition table,
+// which points at a misparsed or deliberately obfuscated file. Returns how
+// many there are.
+static int reportMetadataOverlaps(const PacHeader* pacHeader, PartitionHeader** partHeaders) {
+    uint64_t tableStart = pacHeader->partitionsListStart;
+    uint64_t tableEnd = tableStart;
+    for (int i = 0; i < pacHeader->partitionCount; i++) {
+        tableEnd += partHeaders[i]->length;
+    }
+
+    int overlaps = 0;
+    for (int i = 0; i < pacHeader->partitionCount; i++) {
+        const PartitionHeader* partHeader = partHeaders[i];
+        uint64_t start = partHeader->partitionAddrInPac;
+        uint64_t end = start + partHeader->partitionSize;
+        if (partHeader->partitionSize == 0) {
+            continue;
+        }
+        char partitionName[256];
+        getPartitionName(partHeader, partitionName, sizeof(partitionName));
+        if (start < sizeof(PacHeader)) {
+            uint64_t headerEnd = sizeof(PacHeader);
+            logWarning("overlaps-pac-header", partitionName,
+                       "partition %d: data overlaps the PAC header at bytes 0x%llx-0x%llx", headerIndex(i),
+                       (unsigned long long)start, (unsigned long long)(end < headerEnd ? end : headerEnd) - 1);
+            overlaps++;
+        }
+        if (start < tableEnd && end > tableStart) {
+            logWarning("overlaps-partition-table", partitionName,
+                       "partition %d: data overlaps the partition table at bytes 0x%llx-0x%llx", headerIndex(i),
+                       (unsigned long long)(start > tableStart ? start : tableStart),
+                       (unsigned long long)(end < tableEnd ? end : tableEnd) - 1);
+            overlaps++;
+        }
+    }
+    return overlaps;
+}
+
+// Looks for signs that the headers were parsed with the wrong layout or
+// belong to a different format variant. Returns the number of anomalies.
+static int runFormatChecks(const PacHeader* pacHeader, PartitionHeader** partHeaders) {
+    int anomalies = 0;
+    char version[256];
+    getFormatVersion(pacHeader, version, sizeof(version));
+    if (!isKnownFormatVersion(version)) {
+        logWarning("unknown-format-version", NULL,
+                   "unknown format version \"%s\", the header layout may not match", version);
+        anomalies++;
+    }
+
+    for (int i = 0; i < pacHeader->partitionCount; i++) {
+        const PartitionHeader* partHeader = partHeaders[i];
+        char partitionName[256];
+        getPartitionName(partHeader, partitionName, sizeof(partitionName));
+        int padding = findNonzeroPadding(partHeader->partitionName, 256);
+        if (padding >= 0) {
+            logWarning("nonzero-padding", partitionName,
+                       "partition %d: PartitionName has nonzero padding at unit %d", headerIndex(i), padding);
+            anomalies++;
+        }
+        padding = findNonzeroPadding(partHeader->fileName, 512);
+        if (padding >= 0) {
+            logWarning("nonzero-padding", partitionName, "partition %d: FileName has nonzero padding at unit %d",
+                       headerIndex(i), padding);
+            anomalies++;
+        }
+    }
+
+    anomalies += reportMetadataOverlaps(pacHeader, partHeaders);
+    anomalies += reportDuplicateNames(partHeaders, pacHeader->partitionCount, getPartitionName, namesMatch,
+                                      "partition name");
+    anomalies += reportDuplicateNames(partHeaders, pacHeader->partitionCount, getFileName, fileNamesMatch,
+                                      "file name");
+    return anomalies;
+}
+
+// Lists the largest common boundary each partition's data starts on. This is
+// informational only: misaligned data is slower to map but not wrong.
+static void reportAlignment(const PacHeader* pacHeader, PartitionHeader** partHeaders) {
+    static const uint32_t boundaries[] = { 4096, 512 };
+    int counts[ARRAY_LENGTH(boundaries) + 1] = { 0 };
+
+    for (int i = 0; i < pacHeader->partitionCount; i++) {
+        const PartitionHeader* partHeader = partHeaders[i];
+        if (partHeader->partitionSize == 0) {
+            continue;
+        }
+        size_t b = 0;
+        while (b < ARRAY_LENGTH(boundaries) && partHeader->partitionAddrInPac % boundaries[b] != 0) {
+            b++;
+        }
+        counts[b]++;
+
+        char partitionName[256];
+        getPartitionName(partHeader, partitionName, sizeof(partitionName));
+        if (b < ARRAY_LENGTH(boundaries)) {
+            logInfo("Partition %d (%s) at 0x%x: aligned to %u bytes\n", headerIndex(i), partitionName,
+                    partHeader->partitionAddrInPac, boundaries[b]);
+        } else {
+            logInfo("Partition %d (%s) at 0x%x: not aligned to 512 bytes\n", headerIndex(i), partitionName,
+                    partHeader->partitionAddrInPac);
+        }
+    }
+    logInfo("Alignment: %d at 4096, %d at 512, %d unaligned\n", counts[0], counts[1], counts[2]);
+}
+
+// Compares the length of the partition headers with the PartitionHeader
+// struct, and with the room left for them before the first partition's
+// data. A mismatch means this PAC is a format variant the struct doesn't
+// describe, and fields after the difference may be misread.
+static void reportHeaderStride(const PacHeader* pacHeader, PartitionHeader** partHeaders) {
+    if (pacHeader->partitionCount == 0) {
+        return;
+    }
+
+    uint32_t minLength = UINT32_MAX;
+    uint32_t maxLength = 0;
+    uint32_t firstData = UINT32_MAX;
+    for (int i = 0; i < pacHeader->partitionCount; i++) {
+        const PartitionHeader* partHeader = partHeaders[i];
+        minLength = partHeader->length < minLength ? partHeader->length : minLength;
+        maxLength = partHeader->length > maxLength ? partHeader->length : maxLength;
+        if (partHeader->partitionSize > 0 && partHeader->partitionAddrInPac < firstData) {
+            firstData = partHeader->partitionAddrInPac;
+        }
+    }
+
+    if (minLength == maxLength) {
+        logInfo("Partition header stride: expected %zu bytes, observed %u\n", sizeof(PartitionHeader), minLength);
+    } else {
+        logInfo("Partition header stride: expected %zu bytes, observed %u to %u\n", sizeof(PartitionHeader),
+                minLength, maxLength);
+    }
+    if (firstData != UINT32_MAX && firstData >= (uint32_t)pacHeader->partitionsListStart) {
+        uint64_t room = (firstData - pacHeader->partitionsListStart) / pacHeader->partitionCount;
+        logInfo("Room before the first partition's data: %llu bytes per header\n", (unsigned long long)room);
+    }
+
+    char version[256];
+    getFormatVersion(pacHeader, version, sizeof(version));
+    if (minLength != maxLength) {
+        logWarning("header-length-varies", NULL, "partition headers differ in length, which no known variant does; "
+                   "the PAC may be damaged (try -skip-bad-headers)");
+    } else if (minLength > sizeof(PartitionHeader)) {
+        logWarning("header-length-unexpected", NULL,
+                   "partition headers are %zu bytes longer than expected, suggesting a newer variant "
+                   "than this tool knows (format version %s); the extra bytes are shown as data_array "
+                   "by -save-layout", minLength - sizeof(PartitionHeader), version);
+    }
+}
+
+// Finds "key": "value" in a line of JSON written by this tool and copies the
+// unescaped value. Returns 0 on success.
+static int findJsonString(const char* line, const char* key, char* value, size_t size) {
+    char pattern[64];
+    snprintf(pattern, sizeof(pattern), "\"%s\": \"", key);
+    const char* p = strstr(line, pattern);
+    if (p == NULL) {
+        return -1;
+    }
+    p += strlen(pattern);
+
+    size_t length = 0;
+    while (*p && *p != '"' && length + 1 < size) {
+        if (*p == '\\' && p[1] == 'u') {
+            unsigned int code;
+            if (sscanf(p + 2, "%4x", &code) != 1) {
+                return -1;
+            }
+            value[length++] = (char)code;
+            p += 6;
+        } else if (*p == '\\' && p[1] != '\0') {
+            value[length++] = p[1];
+            p += 2;
+        } else {
+            value[length++] = *p++;
+        }
+    }
+    value[length] = '\0';
+    return *p == '"' ? 0 : -1;
+}
+
+// Finds "key": <number> in a line of JSON written by this tool
+static int findJsonNumber(const char* line, const char* key, uint64_t* value) {
+    char pattern[64];
+    snprintf(pattern, sizeof(pattern), "\"%s\": ", key);
+    const char* p = strstr(line, pattern);
+    if (p == NULL) {
+        return -1;
+    }
+    char* end;
+    *value = strtoull(p + strlen(pattern), &end, 10);
+    return end == p + strlen(pattern) ? -1 : 0;
+}
+
+// Reads the partitions of a -save-layout file, which has one per line, or
+// of every PAC in the array of documents a -multi run writes. Anything else,
+// e.g. a -summary-json file, is rejected rather than read as a layout.
+static void loadSinceManifest(const char* path) {
+    FILE* file = fopen(path, "r");
+    if (file == NULL) {
+        logErrno(path);
+        exit(EXIT_FAILURE);
+    }
+
+    char line[8192];
+    int lineNumber = 0;
+    int documents = 0;
+    int pacHeaders = 0;
+    uint64_t pacOffset = 0;
+    while (fgets(line, sizeof(line), file) != NULL) {
+        lineNumber++;
+        const char* problem = NULL;
+        uint64_t number;
+        char first = line[strspn(line, " \t\r\n")];
+        if (strchr(line, '\n') == NULL && !feof(file)) {
+            problem = "line too long";
+        } else if (lineNumber == 1 && first != '{' && first != '[') {
+            problem = "not JSON";
+        } else if (strstr(line, "\"schema_version\"") != NULL) {
+            if (findJsonNumber(line, "schema_version", &number) != 0 || number != JSON_SCHEMA_VERSION) {
+                problem = "unsupported schema version";
+            }
+            documents++;
+            pacOffset = 0;
+        } else if (strstr(line, "\"pac_header\"") != NULL) {
+            pacHeaders++;
+        } else if (strstr(line, "\"pac_offset\"") != NULL) {
+            if (findJsonNumber(line, "pac_offset", &pacOffset) != 0) {
+                problem = "unrecognized pac_offset";
+            }
+        } else if (strstr(line, "\"partition_name\"") != NULL) {
+            ManifestEntry entry;
+            entry.pacOffset = pacOffset;
+            if (findJsonString(line, "partition_name", entry.partitionName, sizeof(entry.partitionName)) != 0 ||
+                findJsonNumber(line, "partition_size", &entry.partitionSize) != 0 ||
+                findJsonNumber(line, "partition_addr_in_pac", &entry.partitionAddrInPac) != 0) {
+                problem = "unrecognized partition entry";
+            } else {
+                ManifestEntry* entries = realloc(sinceManifest, (sinceManifestCount + 1) * sizeof(ManifestEntry));
+                if (entries == NULL) {
+                    logErrno("Memory allocation failed");
+                    exit(EXIT_FAILURE);
+                }
+                sinceManifest = entries;
+                sinceManifest[sinceManifestCount++] = entry;
+            }
+        }
+        if (problem != NULL) {
+            logError("%s:%d: %s, expected a -save-layout file\n", path, lineNumber, problem);
+            exit(EXIT_FAILURE);
+        }
+    }
+    fclose(file);
+
+    if (documents == 0 || pacHeaders != documents) {
+        logError("%s: no PAC header, expected a -save-layout file\n", path);
+        exit(EXIT_FAILURE);
+    }
+}
+
+// Loads a file in the format written by sha256sum: a hex digest, a space,
+// a space or '*' for binary mode, and the file name
+static void loadExpectedSums(const char* path) {
+    FILE* file = fopen(path, "r");
+    if (file == NULL) {
+        logErrno(path);
+        exit(EXIT_FAILURE);
+    }
+
+    char line[1024];
+    int lineNumber = 0;
+    size_t hashLength = 2 * checksumDigestLength(CHECKSUM_SHA256);
+    while (fgets(line, sizeof(line), file) != NULL) {
+        lineNumber++;
+        line[strcspn(line, "\r\n")] = '\0';
+        if (line[0] == '\0' || line[0] == '#') {
+            continue;
+        }
+
+        ExpectedSum sum = { 0 };
+        size_t length = strspn(line, "0123456789abcdefABCDEF");
+        if (length != hashLength || line[length] != ' ' || (line[length + 1] != ' ' && line[length + 1] != '*')) {
+            logError("%s:%d: expected a SHA-256 digest followed by a file name\n", path, lineNumber);
+            exit(EXIT_FAILURE);
+        }
+        for (size_t i = 0; i < length; i++) {
+            sum.hash[i] = tolower((unsigned char)line[i]);
+        }
+        const char* name = line + length + 2;
+        if (strncmp(name, "./", 2) == 0) {
+            name += 2;
+        }
+        snprintf(sum.fileName, sizeof(sum.fileName), "%s", name);
+
+        ExpectedSum* sums = realloc(expectedSums, (expectedSumCount + 1) * sizeof(ExpectedSum));
+        if (sums == NULL) {
+            logErrno("Memory allocation failed");
+            exit(EXIT_FAILURE);
+        }
+        expectedSums = sums;
+        expectedSums[expectedSumCount++] = sum;
+    }
+    fclose(file);
+}
+
+// Compares the SHA-256 of an extracted file with its -expect-sums entry.
+// Returns "ok", "mismatch" or "missing".
+static const char* verifyExpectedSum(const char* partitionName, const char* fileName, const char* hash) {
+    for (int i = 0; i < expectedSumCount; i++) {
+        if (strcmp(expectedSums[i].fileName, fileName) != 0) {
+            continue;
+        }
+        expectedSums[i].verified = 1;
+        if (strcmp(expectedSums[i].hash, hash) == 0) {
+            logInfo("SHA-256 of %s: OK\n", fileName);
+            sumsPassed++;
+            return "ok";
+        }
+        logError("SHA-256 of %s: MISMATCH, expected %s, got %s\n", fileName, expectedSums[i].hash, hash);
+        sumsFailed++;
+        return "mismatch";
+    }
+    logWarning("expected-sum-missing", partitionName, "No expected checksum for %s", fileName);
+    sumsMissing++;
+    return "missing";
+}
+
+// Prints the -expect-sums summary. Returns whether every check passed.
+static int reportExpectedSums(void) {
+    for (int i = 0; i < expectedSumCount; i++) {
+        if (!expectedSums[i].verified) {
+            logWarning("expected-sum-unused", NULL,
+                       "%s from %s was not extracted", expectedSums[i].fileName, options.expectSumsPath);
+        }
+    }
+    logInfo("Checksum verification %s: %d passed, %d failed, %d without an expected checksum\n",
+            sumsFailed == 0 ? "PASSED" : "FAILED", sumsPassed, sumsFailed, sumsMissing);
+    return sumsFailed == 0;
+}
+
+static int partitionNameMatches(const PartitionHeader* partHeader, const char* name) {
+    char partitionName[1024];
+    getPartitionName(partHeader, partitionName, sizeof(partitionName));
+    return namesMatch(partitionName, name);
+}
+
+// Loads the -alias-file, which has one "alias=name" per line; blank lines
+// and lines starting with '#' are ignored
+static void loadNameAliases(const char* path) {
+    FILE* file = fopen(path, "r");
+    if (file == NULL) {
+        logErrno(path);
+        exit(EXIT_FAILURE);
+    }
+
+    char line[512];
+    int lineNumber = 0;
+    while (fgets(line, sizeof(line), file) != NULL) {
+        lineNumber++;
+        char* text = trimWhitespace(line);
+        if (*text == '\0' || *text == '#') {
+            continue;
+        }
+        char* equals = strchr(text, '=');
+        if (equals == NULL) {
+            logError("%s:%d: expected \"alias=name\"\n", path, lineNumber);
+            exit(EXIT_FAILURE);
+        }
+        *equals = '\0';
+
+        NameAlias alias;
+        snprintf(alias.alias, sizeof(alias.alias), "%s", trimWhitespace(text));
+        snprintf(alias.name, sizeof(alias.name), "%s", trimWhitespace(equals + 1));
+        NameAlias* aliases = realloc(nameAliases, (nameAliasCount + 1) * sizeof(NameAlias));
+        if (aliases == NULL) {
+            logErrno("Memory allocation failed");
+            exit(EXIT_FAILURE);
+        }
+        nameAliases = aliases;
+        nameAliases[nameAliasCount++] = alias;
+    }
+    fclose(file);
+}
+
+// Returns whether the partition is named in a comma-separated list, either
+// by its own name or by an alias for it
+static int partitionNameListed(const PartitionHeader* partHeader, const char* names) {
+    char name[256];
+    while (*names) {
+        size_t length = strcspn(names, ",");
+        snprintf(name, sizeof(name), "%.*s", (int)length, names);
+        if (partitionNameMatches(partHeader, name)) {
+            return 1;
+        }
+        for (int i = 0; i < nameAliasCount; i++) {
+            if (strcasecmp(nameAliases[i].alias, trimWhitespace(name)) == 0 &&
+                partitionNameMatches(partHeader, nameAliases[i].name)) {
+                return 1;
+            }
+        }
+        names += length;
+        if (*names == ',') {
+            names++;
+        }
+    }
+    return 0;
+}
+
+// Returns whether the partition is one of the FDL download agents the flash
+// tool loads into RAM before flashing, rather than a device partition
+static int isFdlPartition(const PartitionHeader* partHeader) {
+    // Always by partition name, which is what the flash tool goes by
+    char partitionName[1024];
+    getString(partHeader->partitionName, ARRAY_LENGTH(partHeader->partitionName), partitionName,
+              sizeof(partitionName));
+    return namesMatch(partitionName, "FDL") || namesMatch(partitionName, "FDL1") ||
+           namesMatch(partitionName, "FDL2");
+}
+
+// Returns whether the -since layout has a partition by the same name with
+// the same size and offset, in the PAC at the same offset
+static int unchangedSinceManifest(const PartitionHeader* partHeader) {
+    for (int i = 0; i < sinceManifestCount; i++) {
+        if (partitionNameMatches(partHeader, sinceManifest[i].partitionName) &&
+            sinceManifest[i].partitionSize == partHeader->partitionSize &&
+            sinceManifest[i].partitionAddrInPac == partHeader->partitionAddrInPac &&
+            sinceManifest[i].pacOffset == (uint64_t)pacBase) {
+            return 1;
+        }
+    }
+    return 0;
+}
+
+// Returns 'a' or 'b' for A/B partitions like boot_a, otherwise 0. The name
+// without the suffix is stored in baseName.
+static char partitionSlot(const PartitionHeader* partHeader, char* baseName, size_t size) {
+    char partitionName[256];
+    getPartitionName(partHeader, partitionName, sizeof(partitionName));
+    size_t length = strlen(partitionName);
+    while (length > 0 && isspace((unsigned char)partitionName[length - 1])) {
+        length--;
+    }
+    snprintf(baseName, size, "%.*s", (int)length, partitionName);
+
+    if (length <= 2 || partitionName[length - 2] != '_') {
+        return 0;
+    }
+    char slot = tolower((unsigned char)partitionName[length - 1]);
+    if (slot != 'a' && slot != 'b') {
+        return 0;
+    }
+    snprintf(baseName, size, "%.*s", (int)length - 2, partitionName);
+    return slot;
+}
+
+// Returns why a partition is left out by the selection options, or NULL if
+// it is to be extracted
+static const char* partitionSkipReason(int index, const PartitionHeader* partHeader) {
+    if (interactiveSelection != NULL && !interactiveSelection[index]) {
+        return "not selected";
+    }
+    if (options.partialName != NULL && !partitionNameMatches(partHeader, options.partialName)) {
+        return "not the -partial-extract partition";
+    }
+    if (options.onlyNames != NULL && !partitionNameListed(partHeader, options.onlyNames)) {
+        return "not in the -only list";
+    }
+    if (options.excludeNames != NULL && partitionNameListed(partHeader, options.excludeNames)) {
+        return "in the -exclude list";
+    }
+    if (detectedTypes != NULL && !isTypeListed(detectedTypes[index], options.typeNames)) {
+        return "content type not in the -type list";
+    }
+    if (options.skipFdl && isFdlPartition(partHeader)) {
+        return "FDL download agent";
+    }
+    char baseName[256];
+    char slot = partitionSlot(partHeader, baseName, sizeof(baseName));
+    if (options.slot != 0 && slot != 0 && slot != options.slot) {
+        return "in the other A/B slot";
+    }
+    if (options.sincePath != NULL && unchangedSinceManifest(partHeader)) {
+        return "unchanged since the -since layout";
+    }
+    if (partHeader->partitionSize > options.maxPartitionSize) {
+        return "larger than -max-partition-size";
+    }
+    if (partHeader->partitionSize < options.minSize || partHeader->partitionSize > options.maxSize) {
+        return "outside the size filter";
+    }
+    return NULL;
+}
+
+// Largest partitions first
+static int compareBySize(const void* a, const void* b) {
+    const PartitionListEntry* left = a;
+    const PartitionListEntry* right = b;
+    if (left->header->partitionSize != right->header->partitionSize) {
+        return left->header->partitionSize > right->header->partitionSize ? -1 : 1;
+    }
+    return left->index - right->index;
+}
+
+static int compareByName(const void* a, const void* b) {
+    const PartitionListEntry* left = a;
+    const PartitionListEntry* right = b;
+    char leftName[256];
+    char rightName[256];
+    getPartitionName(left->header, leftName, sizeof(leftName));
+    getPartitionName(right->header, rightName, sizeof(rightName));
+    int result = strcmp(leftName, rightName);
+    return result != 0 ? result : left->index - right->index;
+}
+
+static int compareByOffset(const void* a, const void* b) {
+    const PartitionListEntry* left = a;
+    const PartitionListEntry* right = b;
+    if (left->header->partitionAddrInPac != right->header->partitionAddrInPac) {
+        return left->header->partitionAddrInPac < right->header->partitionAddrInPac ? -1 : 1;
+    }
+    return left->index - right->index;
+}
+
+// Prints the partition table in the -sort order
+static void printPartitionList(PartitionHeader** partHeaders, int count) {
+    PartitionListEntry* entries = malloc((count > 0 ? count : 1) * sizeof(PartitionListEntry));
+    if (entries == NULL) {
+        logErrno("Memory allocation failed");
+        exit(EXIT_FAILURE);
+    }
+    for (int i = 0; i < count; i++) {
+        entries[i].index = i;
+        entries[i].header = partHeaders[i];
+    }
+
+    switch (options.sortOrder) {
+    case SORT_SIZE:
+        qsort(entries, count, sizeof(PartitionListEntry), compareBySize);
+        break;
+    case SORT_NAME:
+        qsort(entries, count, sizeof(PartitionListEntry), compareByName);
+        break;
+    case SORT_OFFSET:
+        qsort(entries, count, sizeof(PartitionListEntry), compareByOffset);
+        break;
+    default:
+        break;
+    }
+
+    for (int i = 0; i < count; i++) {
+        const PartitionHeader* partHeader = entries[i].header;
+        char partitionName[256];
+        char fileName[512];
+        getPartitionName(partHeader, partitionName, sizeof(partitionName));
+        getFileName(partHeader, fileName, sizeof(fileName));
+        logInfo("Partition name: %s\n\twith file name: %s\n\twith size %u\n",
+                partitionName, fileName, partHeader->partitionSize);
+        if (isFdlPartition(partHeader)) {
+            logInfo("\tFDL download agent, not a flashable partition\n");
+        }
+        const char* skipReason = partitionSkipReason(entries[i].index, partHeader);
+        if (skipReason != NULL) {
+            logInfo("\tskipped: %s\n", skipReason);
+        }
+    }
+    free(entries);
+}
+
+// Estimates the Shannon entropy of a partition in bits per byte from chunks
+// spread evenly across it. Encrypted data is close to 8; so is compressed
+// data, but that is usually recognised by its magic first.
+static double partitionEntropy(int fd, const PartitionHeader* partHeader) {
+    unsigned char* buffer = malloc(ENTROPY_CHUNK_SIZE);
+    if (buffer == NULL) {
+        logErrno("Memory allocation failed");
+        exit(EXIT_FAILURE);
+    }
+
+    uint64_t counts[256] = { 0 };
+    uint64_t total = 0;
+    uint32_t size = partHeader->partitionSize;
+    uint32_t stride = size / ENTROPY_CHUNK_COUNT;
+    for (int chunk = 0; chunk < ENTROPY_CHUNK_COUNT; chunk++) {
+        uint32_t start = (uint32_t)chunk * stride;
+        size_t length = size - start < ENTROPY_CHUNK_SIZE ? size - start : ENTROPY_CHUNK_SIZE;
+        ssize_t rb = pread(fd, buffer, length, pacBase + partHeader->partitionAddrInPac + start);
+        for (ssize_t i = 0; i < rb; i++) {
+            counts[buffer[i]]++;
+        }
+        total += rb > 0 ? rb : 0;
+        if (stride == 0) {
+            break;
+        }
+    }
+    free(buffer);
+
+    double entropy = 0.0;
+    for (int i = 0; i < 256; i++) {
+        if (counts[i] > 0) {
+            double p = (double)counts[i] / total;
+            entropy -= p * log2(p);
+        }
+    }
+    return entropy;
+}
+
+// Prints the -group-slots summary: every A/B partition once, with the
+// slots it has
+static void printSlotGroups(PartitionHeader** partHeaders, int count) {
+    int groups = 0;
+    for (int i = 0; i < count; i++) {
+        char baseName[256];
+        if (partitionSlot(partHeaders[i], baseName, sizeof(baseName)) == 0) {
+            continue;
+        }
+        int seen = 0;
+        for (int j = 0; j < i && !seen; j++) {
+            char otherName[256];
+            seen = partitionSlot(partHeaders[j], otherName, sizeof(otherName)) != 0 &&
+                   namesMatch(otherName, baseName);
+        }
+        if (seen) {
+            continue;
+        }
+
+        char line[512];
+        int length = snprintf(line, sizeof(line), "Slotted partition %s:", baseName);
+        int slots = 0;
+        for (int j = i; j < count; j++) {
+            char otherName[256];
+            char slot = partitionSlot(partHeaders[j], otherName, sizeof(otherName));
+            if (slot != 0 && namesMatch(otherName, baseName) && length < (int)sizeof(line)) {
+                length += snprintf(line + length, sizeof(line) - length, "%s %c (%u bytes)", slots > 0 ? "," : "",
+                                   slot, partHeaders[j]->partitionSize);
+                slots++;
+            }
+        }
+        logInfo("%s%s\n", line, slots == 1 ? ", other slot missing" : "");
+        groups++;
+    }
+    logInfo("%d A/B slotted partitions\n", groups);
+}
+
+// Prints the -list-unknown-fields table, one row per partition
+static void printUnknownFields(PartitionHeader** partHeaders, int count) {
+    logInfo("%-16s %-22s %-22s %-22s %-22s %s\n", "Partition", "someFields1[0]", "someFields1[1]",
+            "someFields2[0]", "someFields2[1]", "someFields2[2]");
+    for (int i = 0; i < count; i++) {
+        const PartitionHeader* partHeader = partHeaders[i];
+        int32_t values[5] = {
+            partHeader->someFields1[0], partHeader->someFields1[1],
+            partHeader->someFields2[0], partHeader->someFields2[1], partHeader->someFields2[2],
+        };
+        char partitionName[256];
+        char line[256];
+        getPartitionName(partHeader, partitionName, sizeof(partitionName));
+        int length = snprintf(line, sizeof(line), "%-16s", partitionName);
+        for (int j = 0; j < 5 && length < (int)sizeof(line); j++) {
+            char cell[32];
+            snprintf(cell, sizeof(cell), "0x%08x (%d)", (uint32_t)values[j], values[j]);
+            length += snprintf(line + length, sizeof(line) - length, " %-*s", j < 4 ? 22 : 0, cell);
+        }
+        logInfo("%s\n", line);
+    }
+}
+
+// Prints the -detect line of every partition
+static void printDetection(int fd, PartitionHeader** partHeaders, int count) {
+    for (int i = 0; i < count; i++) {
+        const PartitionHeader* partHeader = partHeaders[i];
+        char partitionName[256];
+        getPartitionName(partHeader, partitionName, sizeof(partitionName));
+        if (partHeader->partitionSize == 0) {
+            logInfo("%s: empty\n", partitionName);
+            continue;
+        }
+        const MagicSignature* sig = detectSignature(fd, partHeader);
+        double entropy = partitionEntropy(fd, partHeader);
+        logInfo("%s: %s, entropy %.2f bits/byte%s\n", partitionName, sig != NULL ? sig->type : "unknown",
+                entropy, sig == NULL && entropy >= ENCRYPTED_ENTROPY ? ", likely encrypted" : "");
+    }
+}
+
+// Parses a selection like "0,2,4-6" or "all" into selected, which has one
+// entry per partition. Returns 0 on success.
+static int parseSelection(const char* text, int count, unsigned char* selected) {
+    memset(selected, 0, count);
+    if (strcmp(text, "all") == 0) {
+        memset(selected, 1, count);
+        return 0;
+    }
+
+    const char* p = text;
+    while (*p) {
+        char* end;
+        long first = strtol(p, &end, 10);
+        if (end == p) {
+            return -1;
+        }
+        long last = first;
+        p = end;
+        if (*p == '-') {
+            p++;
+            last = strtol(p, &end, 10);
+            if (end == p) {
+                return -1;
+            }
+            p = end;
+        }
+        if (first < 0 || last >= count || first > last) {
+            return -1;
+        }
+        for (long i = first; i <= last; i++) {
+            selected[i] = 1;
+        }
+
+        while (*p == ' ') {
+            p++;
+        }
+        if (*p == ',') {
+            p++;
+            while (*p == ' ') {
+                p++;
+            }
+        } else if (*p != '\0') {
+            return -1;
+        }
+    }
+    return 0;
+}
+
+// Lists the partitions with their indices and asks which ones to extract
+// until the answer is a valid selection. Falls back to extracting every
+// partition when stdin isn't a terminal.
+static void selectPartitionsInteractively(PartitionHeader** partHeaders, int count) {
+    if (!isatty(STDIN_FILENO)) {
+        logWarning("interactive-no-terminal", NULL, "stdin is not a terminal, ignoring -interactive");
+        return;
+    }
+
+    // Selections are made by position in the partition table, which has
+    // gaps where -skip-bad-headers stepped over a header
+    int tableLength = count > 0 ? headerIndex(count - 1) + 1 : 0;
+    unsigned char* tableSelection = malloc(tableLength > 0 ? tableLength : 1);
+    interactiveSelection = malloc(count > 0 ? count : 1);
+    if (interactiveSelection == NULL || tableSelection == NULL) {
+        logErrno("Memory allocation failed");
+        exit(EXIT_FAILURE);
+    }
+
+    printf("\n");
+    for (int i = 0; i < count; i++) {
+        char partitionName[256];
+        char fileName[512];
+        getPartitionName(partHeaders[i], partitionName, sizeof(partitionName));
+        getFileName(partHeaders[i], fileName, sizeof(fileName));
+        printf("%4d  %-24s %-32s %u\n", headerIndex(i), partitionName, fileName, partHeaders[i]->partitionSize);
+    }
+
+    char line[1024];
+    for (;;) {
+        printf("Partitions to extract (e.g. 0,2,4-6 or all): ");
+        fflush(stdout);
+        if (fgets(line, sizeof(line), stdin) == NULL) {
+            logError("\nNo selection made\n");
+            exit(EXIT_FAILURE);
+        }
+        if (parseSelection(trimWhitespace(line), tableLength, tableSelection) == 0) {
+            for (int i = 0; i < count; i++) {
+                interactiveSelection[i] = tableSelection[headerIndex(i)];
+            }
+            free(tableSelection);
+            return;
+        }
+        printf("Invalid selection, use indices between 0 and %d\n", tableLength - 1);
+    }
+}
+
+static int isOutputNameUsed(const char* name) {
+    for (int i = 0; i < usedOutputNameCount; i++) {
+        if (strcmp(usedOutputNames[i], name) == 0) {
+            return 1;
+        }
+    }
+    return 0;
+}
+
+static void addUsedOutputName(const char* name) {
+    char** names = realloc(usedOutputNames, (usedOutputNameCount + 1) * sizeof(char*));
+    if (names == NULL || (names[usedOutputNameCount] = strdup(name)) == NULL) {
+        logErrno("Memory allocation failed");
+        exit(EXIT_FAILURE);
+    }
+    usedOutputNames = names;
+    usedOutputNameCount++;
+}
+
+static void freeUsedOutputNames(void) {
+    for (int i = 0; i < usedOutputNameCount; i++) {
+        free(usedOutputNames[i]);
+    }
+    free(usedOutputNames);
+    usedOutputNames = NULL;
+    usedOutputNameCount = 0;
+}
+
+// Applies -infer-ext, -flatten and -lowercase-names to a partition's file
+// name. Returns the signature an extension was inferred from, or NULL.
+static const MagicSignature* getTransformedFileName(int fd, const PartitionHeader* partHeader, char* fileName,
+                                                    size_t size) {
+    const MagicSignature* sig = NULL;
+    getFileName(partHeader, fileName, size);
+    if (options.inferExtension && !hasExtension(fileName)) {
+        sig = detectSignature(fd, partHeader);
+        strncat(fileName, sig ? sig->extension : ".bin", size - strlen(fileName) - 1);
+    }
+
+    if (options.flatten) {
+        for (char* c = fileName; *c; c++) {
+            if (*c == '/' || *c == '\\') {
+                *c = '_';
+            }
+        }
+    }
+    if (options.lowercaseNames) {
+        for (char* c = fileName; *c; c++) {
+            *c = tolower((unsigned char)*c);
+        }
+    }
+    return sig;
+}
+
+// Puts a file name into the partition's directory for -subdir-per-partition
+static void addPartitionDirectory(int index, const PartitionHeader* partHeader, char* fileName, size_t size) {
+    char directory[256];
+    getPartitionName(partHeader, directory, sizeof(directory));
+    for (char* c = directory; *c; c++) {
+        if (*c == '/' || *c == '\\') {
+            *c = '_';
+        }
+    }
+    if (directory[0] == '\0' || strcmp(directory, ".") == 0 || strcmp(directory, "..") == 0) {
+        snprintf(directory, sizeof(directory), "partition%d", index);
+    }
+
+    // A cut off name would lose its end, e.g. its extension, and could then
+    // collide with another
+    char original[512];
+    snprintf(original, sizeof(original), "%s", fileName);
+    if (snprintf(fileName, size, "%s/%s", directory, original) >= (int)size) {
+        logError("Output file name %s/%s is too long\n", directory, original);
+        exit(EXIT_FAILURE);
+    }
+}
+
+// Works out the path of a partition's output file relative to the output
+// directory, applying -infer-ext, -flatten and -lowercase-names, renaming
+// the file if one of those made its name collide with an earlier one, and
+// putting it in its own directory under -subdir-per-partition
+static void getOutputFileName(int fd, int index, const PartitionHeader* partHeader, char* fileName, size_t size) {
+    const MagicSignature* sig = getTransformedFileName(fd, partHeader, fileName, size);
+    if (options.inferExtension) {
+        char headerFileName[512];
+        getFileName(partHeader, headerFileName, sizeof(headerFileName));
+        if (!hasExtension(headerFileName)) {
+            logInfo("Inferred extension %s for %s (%s)\n", sig ? sig->extension : ".bin", headerFileName,
+                    sig ? sig->type : "unknown data");
+        }
+    }
+
+    if (options.flatten || options.lowercaseNames) {
+        // Two partitions may end up with the same name, e.g. a/b.img and
+        // a_b.img or Boot.img and boot.img, so tell them apart by the
+        // partition index
+        if (isOutputNameUsed(fileName)) {
+            char original[512];
+            snprintf(original, sizeof(original), "%s", fileName);
+            char* dot = strrchr(original, '.');
+            size_t stemLength = dot != NULL && dot != original ? (size_t)(dot - original) : strlen(original);
+            snprintf(fileName, size, "%.*s_%d%s", (int)stemLength, original, index, original + stemLength);
+            char partitionName[256];
+            getPartitionName(partHeader, partitionName, sizeof(partitionName));
+            logWarning("output-name-renamed", partitionName,
+                       "%s would overwrite the file of another partition, writing %s instead", original, fileName);
+        }
+        addUsedOutputName(fileName);
+    }
+
+    if (options.subdirPerPartition) {
+        addPartitionDirectory(index, partHeader, fileName, size);
+    }
+}
+
+// Checks, before anything is written, whether two partitions to be
+// extracted end up with the same output file once the name options have
+// been applied. -flatten and -lowercase-names rename such files, otherwise
+// one would overwrite the other. Returns the number of collisions.
+static int reportOutputNameCollisions(int fd, PartitionHeader** partHeaders, int count) {
+    char (*names)[512] = malloc((count > 0 ? count : 1) * sizeof(*names));
+    if (names == NULL) {
+        logErrno("Memory allocation failed");
+        exit(EXIT_FAILURE);
+    }
+    for (int i = 0; i < count; i++) {
+        names[i][0] = '\0';
+        if (partHeaders[i]->partitionSize == 0 || partitionSkipReason(i, partHeaders[i]) != NULL) {
+            continue;
+        }
+        getTransformedFileName(fd, partHeaders[i], names[i], sizeof(names[i]));
+        if (options.subdirPerPartition) {
+            addPartitionDirectory(i, partHeaders[i], names[i], sizeof(names[i]));
+        }
+    }
+
+    int collisions = 0;
+    int renamed = options.flatten || options.lowercaseNames;
+    for (int i = 0; i < count; i++) {
+        for (int j = 0; j < i && names[i][0] != '\0'; j++) {
+            if (strcmp(names[i], names[j]) != 0) {
+                continue;
+            }
+            char firstName[256];
+            char secondName[256];
+            getPartitionName(partHeaders[j], firstName, sizeof(firstName));
+            getPartitionName(partHeaders[i], secondName, sizeof(secondName));
+            logWarning("output-name-collision", secondName,
+                       "partitions %s and %s both map to %s, %s", firstName, secondName, names[i],
+                       renamed ? "the second gets its index added" : "the second would overwrite the first");
+            collisions++;
+            break;
+        }
+    }
+    free(names);
+    return collisions;
+}
+
+// Appends text to a command line wrapped in single quotes, so the shell
+// takes it literally. Returns the new length.
+static size_t appendShellQuoted(char* command, size_t length, size_t size, const char* text) {
+    length += snprintf(command + length, length < size ? size - length : 0, "'");
+    for (; *text; text++) {
+        if (*text == '\'') {
+            length += snprintf(command + length, length < size ? size - length : 0, "'\\''");
+        } else if (length + 1 < size) {
+            command[length++] = *text;
+            command[length] = '\0';
+        } else {
+            length++;
+        }
+    }
+    length += snprintf(command + length, length < size ? size - length : 0, "'");
+    return length;
+}
+
+// Runs the -exec command for an extracted partition. A failing command
+// fails the run, unless -keep-going is set. Returns 0 if it succeeded.
+static int runExecHook(const char* outputFilePath, const PartitionHeader* partHeader) {
+    char partitionName[256];
+    getPartitionName(partHeader, partitionName, sizeof(partitionName));
+    char size[16];
+    snprintf(size, sizeof(size), "%u", partHeader->partitionSize);
+
+    char command[8192];
+    size_t length = 0;
+    command[0] = '\0';
+    for (const char* p = options.execCommand; *p; ) {
+        if (strncmp(p, "{file}", 6) == 0) {
+            length = appendShellQuoted(command, length, sizeof(command), outputFilePath);
+            p += 6;
+        } else if (strncmp(p, "{partition}", 11) == 0) {
+            length = appendShellQuoted(command, length, sizeof(command), partitionName);
+            p += 11;
+        } else if (strncmp(p, "{size}", 6) == 0) {
+            length = appendShellQuoted(command, length, sizeof(command), size);
+            p += 6;
+        } else {
+            if (length + 1 < sizeof(command)) {
+                command[length] = *p;
+                command[length + 1] = '\0';
+            }
+            length++;
+            p++;
+        }
+    }
+    if (length >= sizeof(command)) {
+        logError("-exec command for %s is too long\n", outputFilePath);
+        exit(EXIT_FAILURE);
+    }
+
+    fflush(stdout);
+    int status = system(command);
+    if (status == 0) {
+        return 0;
+    }
+
+    if (status == -1) {
+        logErrno("Error running -exec command");
+    } else if (WIFEXITED(status)) {
+        logError("-exec command for %s exited with status %d\n", outputFilePath, WEXITSTATUS(status));
+    } else {
+        logError("-exec command for %s was terminated by a signal\n", outputFilePath);
+    }
+    if (!options.keepGoing) {
+        exit(EXIT_FAILURE);
+    }
+    failedPartitionCount++;
+    return -1;
+}
+
+// Returns the -filter-cmd command for a partition, or NULL if it has none
+static const char* partitionFilterCommand(const PartitionHeader* partHeader) {
+    for (int i = 0; i < options.filterCommandCount; i++) {
+        if (partitionNameMatches(partHeader, options.filterCommands[i].partitionName)) {
+            return options.filterCommands[i].command;
+        }
+    }
+    return NULL;
+}
+
+// Starts a -filter-cmd command writing to outputFd and returns the end of
+// the pipe to feed it the partition data through. Its stderr is ours.
+static int startFilter(const char* command, int outputFd, pid_t* pid) {
+    int pipeFds[2];
+    if (pipe(pipeFds) == -1) {
+        logErrno("Error creating pipe for -filter-cmd");
+        exit(EXIT_FAILURE);
+    }
+    // A filter that exits early should fail its partition, not kill us
+    signal(SIGPIPE, SIG_IGN);
+
+    fflush(stdout);
+    *pid = fork();
+    if (*pid == -1) {
+        logErrno("Error starting -filter-cmd command");
+        exit(EXIT_FAILURE);
+    }
+    if (*pid == 0) {
+        if (dup2(pipeFds[0], STDIN_FILENO) == -1 || dup2(outputFd, STDOUT_FILENO) == -1) {
+            _exit(127);
+        }
+        close(pipeFds[0]);
+        close(pipeFds[1]);
+        close(outputFd);
+        signal(SIGPIPE, SIG_DFL);
+        execl("/bin/sh", "sh", "-c", command, (char*)NULL);
+        _exit(127);
+    }
+    close(pipeFds[0]);
+    return pipeFds[1];
+}
+
+// Waits for a -filter-cmd command. Returns 0 if it succeeded; otherwise
+// fails the run, or under -keep-going just the partition.
+static int finishFilter(pid_t pid, const char* outputFilePath) {
+    int status;
+    while (waitpid(pid, &status, 0) == -1) {
+        if (errno != EINTR) {
+            logErrno("Error waiting for -filter-cmd command");
+            exit(EXIT_FAILURE);
+        }
+    }
+    if (WIFEXITED(status) && WEXITSTATUS(status) == 0) {
+        return 0;
+    }
+
+    if (WIFEXITED(status)) {
+        logError("-filter-cmd command for %s exited with status %d\n", outputFilePath, WEXITSTATUS(status));
+    } else {
+        logError("-filter-cmd command for %s was terminated by a signal\n", outputFilePath);
+    }
+    if (!options.keepGoing) {
+        exit(EXIT_FAILURE);
+    }
+    failedPartitionCount++;
+    return -1;
+}
+
+static void getParentDirectory(const char* filePath, char* directory, size_t size) {
+    snprintf(directory, size, "%s", filePath);
+    char* slash = strrchr(directory, '/');
+    if (slash == NULL) {
+        snprintf(directory, size, ".");
+    } else if (slash == directory) {
+        slash[1] = '\0';
+    } else {
+        *slash = '\0';
+    }
+}
+
+// Makes the directory entries of newly created files durable
+static int syncDirectory(const char* directory) {
+    int fd = open(directory, O_RDONLY | O_DIRECTORY);
+    if (fd == -1) {
+        return -1;
+    }
+    int result = fsync(fd);
+    close(fd);
+    return result;
+}
+
+// Syncs the directories the extracted files of a PAC went to for -fsync.
+// Doing it once per directory at the end, rather than after every file,
+// saves a sync per partition for PACs with hundreds of small ones.
+static void syncOutputDirectories(const char* outputPath, const PartitionStats* stats, int count) {
+    char (*synced)[768] = malloc((count > 0 ? count : 1) * sizeof(*synced));
+    if (synced == NULL) {
+        logErrno("Memory allocation failed");
+        exit(EXIT_FAILURE);
+    }
+    int syncedCount = 0;
+    for (int i = 0; i < count; i++) {
+        if (stats[i].outputFileName[0] == '\0') {
+            continue;
+        }
+        char outputFilePath[768];
+        char directory[768];
+        snprintf(outputFilePath, sizeof(outputFilePath), "%s/%s", outputPath, stats[i].outputFileName);
+        getParentDirectory(outputFilePath, directory, sizeof(directory));
+
+        int seen = 0;
+        for (int j = 0; j < syncedCount && !seen; j++) {
+            seen = strcmp(synced[j], directory) == 0;
+        }
+        if (seen) {
+            continue;
+        }
+        if (syncDirectory(directory) != 0) {
+            logErrno("Error syncing output directory to disk");
+            exit(EXIT_FAILURE);
+        }
+        snprintf(synced[syncedCount++], sizeof(synced[0]), "%s", directory);
+    }
+    free(synced);
+}
+
+// Writes one -progress-fd line. A frontend that stops reading shouldn't
+// break the extraction, so write errors are ignored.
+static void writeProgressLine(const PartitionHeader* partHeader, uint32_t bytes, uint32_t total) {
+    char partitionName[256];
+    getPartitionName(partHeader, partitionName, sizeof(partitionName));
+    dprintf(options.progressFd, "%s\t%u\t%u\n", partitionName, bytes, total);
+}
+
+// Copies through buffer, which holds options.bufferSize bytes. Returns the
+// number of bytes written. Also records the output file name, checksums and
+// hook result in stats.
+static uint32_t extractPartition(int fd, int index, const PartitionHeader* partHeader, const char* outputPath,
+                                 off_t firmwareSize, char* buffer, PartitionStats* stats) {
+    if (partHeader->partitionSize == 0) {
+        return 0;
+    }
+
+    // -partial-extract only copies a slice of the partition
+    off_t dataOffset = partHeader->partitionAddrInPac;
+    uint32_t dataSize = partHeader->partitionSize;
+    if (options.partialName != NULL) {
+        dataOffset += options.partialOffset;
+        dataSize = options.partialLength;
+    }
+
+    // Some vendors' size fields are a little off; trust them only as far
+    // as the file goes, and only when it's off by a little
+    off_t available = firmwareSize - (pacBase + dataOffset);
+    if (options.clamp && available >= 0 && dataSize > available && dataSize - available <= CLAMP_TOLERANCE) {
+        char partitionName[256];
+        getPartitionName(partHeader, partitionName, sizeof(partitionName));
+        stats->clampedBytes = dataSize - available;
+        logWarning("partition-clamped", partitionName,
+                   "partition %s reaches %u bytes past the end of the file, clamping it to %u bytes",
+                   partitionName, stats->clampedBytes, (uint32_t)available);
+        dataSize = available;
+    }
+    // Checked before the output file is created, so that no partial file is
+    // left behind
+    if (available < 0 || dataSize > available) {
+        char partitionName[256];
+        getPartitionName(partHeader, partitionName, sizeof(partitionName));
+        logError("Partition %s: %u bytes at 0x%llx reach past the end of the %lld byte file%s\n", partitionName,
+                 dataSize, (unsigned long long)(pacBase + dataOffset), (long long)firmwareSize,
+                 options.clamp ? "" : " (try -clamp)");
+        exit(EXIT_FAILURE);
+    }
+
+    char outputFilePath[768];
+    char fileName[512];
+    getOutputFileName(fd, index, partHeader, fileName, sizeof(fileName));
+    if (options.partialName != NULL) {
+        strncat(fileName, ".partial", sizeof(fileName) - strlen(fileName) - 1);
+    }
+    snprintf(outputFilePath, sizeof(outputFilePath), "%s/%s", outputPath, fileName);
+    snprintf(stats->outputFileName, sizeof(stats->outputFileName), "%s", fileName);
+    if (options.subdirPerPartition) {
+        char directory[768];
+        snprintf(directory, sizeof(directory), "%s", outputFilePath);
+        *strrchr(directory, '/') = '\0';
+        createOutputDirectory(directory);
+    }
+
+    // A FIFO or other special file that already exists is written to as is,
+    // e.g. to stream a partition into a process reading a named pipe
+    struct stat outputStat;
+    int specialOutput = stat(outputFilePath, &outputStat) == 0 && !S_ISREG(outputStat.st_mode) &&
+                        !S_ISDIR(outputStat.st_mode);
+    // Overwriting a disk partition by accident is too easy with a symlink
+    // in the output directory, so devices need to be asked for
+    if (specialOutput && (S_ISBLK(outputStat.st_mode) || S_ISCHR(outputStat.st_mode)) && !options.allowDevice) {
+        logError("Refusing to write to device %s, use -allow-device to write to it in place\n", outputFilePath);
+        exit(EXIT_FAILURE);
+    }
+    int openFlags = O_WRONLY;
+    if (!specialOutput) {
+        if (remove(outputFilePath) == -1 && errno != ENOENT) {
+            logErrno("Error removing existing output file");
+            exit(EXIT_FAILURE);
+        }
+        openFlags |= O_CREAT | O_TRUNC;
+    }
+
+    int fd_new = open(outputFilePath, openFlags, 0666);
+    if (fd_new == -1) {
+        logErrno("Error creating output file");
+        exit(EXIT_FAILURE);
+    }
+
+    // With -filter-cmd the data goes to the command, which writes the file
+    const char* filterCommand = partitionFilterCommand(partHeader);
+    stats->filtered = filterCommand != NULL;
+    pid_t filterPid = -1;
+    int dataFd = filterCommand != NULL ? startFilter(filterCommand, fd_new, &filterPid) : fd_new;
+
+    // Buffer the output so that small writes, e.g. at the end of a
+    // partition, don't each cost a syscall
+    FILE* output = fdopen(dataFd, "w");
+    if (output == NULL || setvbuf(output, NULL, _IOFBF, options.writeBufferSize) != 0) {
+        logErrno("Error setting up output file buffer");
+        close(dataFd);
+        close(fd_new);
+        exit(EXIT_FAILURE);
+    }
+
+    if (!options.compact) {
+        logInfo("Extracting to %s%s\n", outputFilePath, specialOutput ? " (special file)" : "");
+    }
+    double startTime = monotonicSeconds();
+
+    uint32_t dataSizeLeft = dataSize;
+    uint32_t dataSizeRead = 0;
+
+    uint32_t crc = 0;
+    ProgressRate rate = { .lastTime = monotonicSeconds() };
+    double lastRenderTime = 0;
+    double lastProgressLineTime = 0;
+    unsigned int checksumAlgorithms = options.checksumAlgorithms;
+    if (options.expectSumsPath != NULL) {
+        checksumAlgorithms |= 1u << CHECKSUM_SHA256;
+    }
+    ChecksumContext checksums[CHECKSUM_COUNT];
+    for (int algo = 0; algo < CHECKSUM_COUNT; algo++) {
+        if (checksumAlgorithms & (1u << algo)) {
+            checksumInit(&checksums[algo], algo);
+        }
+    }
+
+    while (dataSizeLeft > 0) {
+        uint32_t copyLength = (dataSizeLeft > options.bufferSize) ? options.bufferSize : dataSizeLeft;
+        ssize_t rb = readPartitionData(fd, buffer, copyLength, pacBase + dataOffset + dataSizeRead);
+        if (rb >= 0 && rb != copyLength) {
+            // The file got shorter since its size was checked
+            logError("Error while reading partition data: unexpected end of file\n");
+            fclose(output);
+            exit(EXIT_FAILURE);
+        } else if (rb != copyLength) {
+            logErrno("Error while reading partition data");
+            fclose(output);
+            exit(EXIT_FAILURE);
+        }
+        if (fwrite(buffer, 1, copyLength, output) != copyLength) {
+            // A filter may stop reading early; its exit status tells
+            // whether that was fine
+            if (filterPid != -1 && errno == EPIPE) {
+                break;
+            }
+            logErrno("Error while writing partition data");
+            fclose(output);
+            exit(EXIT_FAILURE);
+        }
+        if (options.crcCheck) {
+            crc = crc32Update(crc, buffer, copyLength);
+        }
+        for (int algo = 0; algo < CHECKSUM_COUNT; algo++) {
+            if (checksumAlgorithms & (1u << algo)) {
+                checksumUpdate(&checksums[algo], buffer, copyLength);
+            }
+        }
+        dataSizeLeft -= copyLength;
+        dataSizeRead += copyLength;
+        if (options.progressFd != -1 && dataSizeLeft > 0 &&
+            monotonicSeconds() - lastProgressLineTime >= PROGRESS_INTERVAL) {
+            writeProgressLine(partHeader, dataSizeRead, dataSize);
+            lastProgressLineTime = monotonicSeconds();
+        }
+        if (options.quiet || options.bench) {
+            continue;
+        }
+        // Redrawing after every buffer costs more than the copy for fast
+        // disks, so redraw at most PROGRESS_INTERVAL apart and at the end
+        double now = monotonicSeconds();
+        if (now - lastRenderTime < PROGRESS_INTERVAL && dataSizeLeft > 0) {
+            continue;
+        }
+        lastRenderTime = now;
+        updateProgressRate(&rate, dataSizeRead);
+        printProgressBar(dataSizeRead, dataSize, &rate);
+    }
+    if (!options.compact) {
+        logInfo("\n");
+    }
+    if (options.progressFd != -1) {
+        writeProgressLine(partHeader, dataSizeRead, dataSize);
+    }
+
+    if (fflush(output) != 0 && !(filterPid != -1 && errno == EPIPE)) {
+        logErrno("Error while writing partition data");
+        fclose(output);
+        exit(EXIT_FAILURE);
+    }
+    if (filterPid != -1) {
+        // The filter has written all of the file once it has seen the end
+        // of the data and exited; the output file is ours again after that
+        fclose(output);
+        stats->hookFailed = finishFilter(filterPid, outputFilePath) != 0;
+        output = fdopen(fd_new, "w");
+        if (output == NULL) {
+            logErrno("Error reopening output file");
+            exit(EXIT_FAILURE);
+        }
+    }
+    // No header field is known to hold a build time, though the unknown
+    // ones, e.g. someIntFields1, might. Until one is found, the PAC file's
+    // own time is the best there is.
+    if (options.preserveTime && !specialOutput) {
+        struct stat firmwareStat;
+        if (fstat(fd, &firmwareStat) == -1) {
+            logErrno("Error getting file stats");
+            fclose(output);
+            exit(EXIT_FAILURE);
+        }
+        struct timespec times[2] = { firmwareStat.st_atim, firmwareStat.st_mtim };
+        if (futimens(fd_new, times) != 0) {
+            logErrno("Error setting output file time");
+            fclose(output);
+            exit(EXIT_FAILURE);
+        }
+    }
+    // Data written to a block device sits in the page cache just like file
+    // data. The directory is synced once all partitions are written.
+    int syncOutput = options.fsync && (!specialOutput || S_ISBLK(outputStat.st_mode));
+    if (syncOutput && fsync(fd_new) != 0) {
+        logErrno("Error syncing output file to disk");
+        fclose(output);
+        exit(EXIT_FAILURE);
+    }
+    struct stat writtenStat = { 0 };
+    if (!specialOutput && filterPid == -1 &&
+        (fstat(fd_new, &writtenStat) == -1 || writtenStat.st_size != (off_t)dataSizeRead)) {
+        logError("Output file %s has %lld bytes instead of %u\n", outputFilePath,
+                 (long long)writtenStat.st_size, dataSizeRead);
+        fclose(output);
+        exit(EXIT_FAILURE);
+    }
+    logToFile("Wrote %u of %u bytes to %s\n", dataSizeRead, dataSize, outputFilePath);
+    if (options.compact) {
+        // Replace the progress bar with the summary line
+        if (!options.quiet && !options.bench) {
+            printf("\r\033[K");
+        }
+        double seconds = monotonicSeconds() - startTime;
+        char sizeText[32];
+        formatSize(dataSizeRead, sizeText, sizeof(sizeText));
+        logInfo("[OK] %s  %s  %.1fs  %.0f MB/s\n", fileName, sizeText, seconds,
+                bytesPerSecond(dataSizeRead, seconds) / 1e6);
+    }
+    if (options.crcCheck) {
+        reportCrcCheck(partHeader, fileName, crc);
+    }
+    for (int algo = 0; algo < CHECKSUM_COUNT; algo++) {
+        if (!(checksumAlgorithms & (1u << algo))) {
+            continue;
+        }
+        char hex[2 * CHECKSUM_MAX_DIGEST_LENGTH + 1];
+        checksumFinalHex(&checksums[algo], hex);
+        snprintf(stats->checksums[algo], sizeof(stats->checksums[algo]), "%s", hex);
+        if (options.checksumAlgorithms & (1u << algo)) {
+            logInfo("%s of %s: %s\n", checksumName(algo), fileName, hex);
+        }
+        if (options.expectSumsPath != NULL && algo == CHECKSUM_SHA256) {
+            char partitionName[256];
+            getPartitionName(partHeader, partitionName, sizeof(partitionName));
+            stats->expectedSum = verifyExpectedSum(partitionName, fileName, hex);
+        }
+    }
+    if (fclose(output) != 0) {
+        logErrno("Error closing output file");
+        exit(EXIT_FAILURE);
+    }
+
+    if (options.execCommand != NULL && !stats->hookFailed) {
+        stats->hookFailed = runExecHook(outputFilePath, partHeader) != 0;
+    }
+    return dataSizeRead;
+}
+
+// Copies length bytes at offset in the file to a file descriptor the caller
+// opened, without progress output
+static void copyRangeToFd(int fd, off_t offset, uint64_t length, int targetFd) {
+    char* buffer = malloc(options.bufferSize);
+    if (buffer == NULL) {
+        logErrno("Memory allocation failed");
+        exit(EXIT_FAILURE);
+    }
+
+    uint64_t dataSizeLeft = length;
+    while (dataSizeLeft > 0) {
+        size_t copyLength = dataSizeLeft > options.bufferSize ? options.bufferSize : dataSizeLeft;
+        if (readPartitionData(fd, buffer, copyLength, offset) != (ssize_t)copyLength) {
+            logErrno("Error while reading partition data");
+            exit(EXIT_FAILURE);
+        }
+        for (size_t written = 0; written < copyLength;) {
+            ssize_t wb = write(targetFd, buffer + written, copyLength - written);
+            if (wb == -1 && errno == EINTR) {
+                continue;
+            } else if (wb <= 0) {
+                logErrno("Error while writing partition data");
+                exit(EXIT_FAILURE);
+            }
+            written += wb;
+        }
+        offset += copyLength;
+        dataSizeLeft -= copyLength;
+    }
+    free(buffer);
+}
+
+// Copies the data of a partition to a file descriptor the caller opened.
+// Returns the number of bytes written.
+static uint32_t copyPartitionToFd(int fd, const PartitionHeader* partHeader, int targetFd) {
+    copyRangeToFd(fd, pacBase + partHeader->partitionAddrInPac, partHeader->partitionSize, targetFd);
+    return partHeader->partitionSize;
+}
+
+// Writes each -extract-to-fd partition to its file descriptor
+static void extractToFdTargets(int fd, const PacHeader* pacHeader, PartitionHeader** partHeaders) {
+    for (int t = 0; t < options.fdTargetCount; t++) {
+        const FdTarget* target = &options.fdTargets[t];
+        int flags = fcntl(target->fd, F_GETFL);
+        if (flags == -1 || (flags & O_ACCMODE) == O_RDONLY) {
+            logError("File descriptor %d for %s is not open for writing\n", target->fd, target->partitionName);
+            exit(EXIT_FAILURE);
+        }
+
+        int found = 0;
+        for (int i = 0; i < pacHeader->partitionCount && !found; i++) {
+            if (partitionNameMatches(partHeaders[i], target->partitionName)) {
+                uint32_t written = copyPartitionToFd(fd, partHeaders[i], target->fd);
+                if (target->fd == stdoutPartitionFd) {
+                    logInfo("Wrote %u bytes of %s to stdout\n", written, target->partitionName);
+                } else {
+                    logInfo("Wrote %u bytes of %s to file descriptor %d\n", written, target->partitionName,
+                            target->fd);
+                }
+                found = 1;
+            }
+        }
+        if (!found) {
+            logError("No partition named %s\n", target->partitionName);
+            exit(EXIT_FAILURE);
+        }
+    }
+}
+
+// Writes the selected partitions into the -combine image in offset order.
+// Without -fill-gaps they are packed back to back; with it each one lands
+// at its distance from the first, so the gaps between them read as zeros.
+static void writeCombinedImage(int fd, const PacHeader* pacHeader, PartitionHeader** partHeaders) {
+    int count = pacHeader->partitionCount;
+    PartitionListEntry* entries = malloc((count > 0 ? count : 1) * sizeof(PartitionListEntry));
+    if (entries == NULL) {
+        logErrno("Memory allocation failed");
+        exit(EXIT_FAILURE);
+    }
+    int selectedCount = 0;
+    for (int i = 0; i < count; i++) {
+        if (partHeaders[i]->partitionSize > 0 && partitionSkipReason(i, partHeaders[i]) == NULL) {
+            entries[selectedCount].index = i;
+            entries[selectedCount].header = partHeaders[i];
+            selectedCount++;
+        }
+    }
+    qsort(entries, selectedCount, sizeof(PartitionListEntry), compareByOffset);
+
+    // Like -offsets-csv, later PACs of a -multi dump are appended
+    int outFd = open(options.combinePath, O_WRONLY | O_CREAT | (pacBase == 0 ? O_TRUNC : 0), 0644);
+    off_t imageStart = outFd != -1 ? lseek(outFd, 0, SEEK_END) : -1;
+    if (outFd == -1 || imageStart == -1) {
+        logErrno("Error opening combined image");
+        exit(EXIT_FAILURE);
+    }
+    FILE* map = NULL;
+    if (options.combineMapPath != NULL) {
+        map = fopen(options.combineMapPath, pacBase == 0 ? "w" : "a");
+        if (map == NULL) {
+            logErrno("Error creating combined image map");
+            exit(EXIT_FAILURE);
+        }
+        if (pacBase == 0) {
+            fprintf(map, "name,offset,size\n");
+        }
+    }
+
+    uint64_t position = imageStart;
+    for (int i = 0; i < selectedCount; i++) {
+        const PartitionHeader* partHeader = entries[i].header;
+        if (options.fillGaps) {
+            position = imageStart + partHeader->partitionAddrInPac - entries[0].header->partitionAddrInPac;
+        }
+        if (lseek(outFd, position, SEEK_SET) == -1) {
+            logErrno("Error seeking in combined image");
+            exit(EXIT_FAILURE);
+        }
+        copyPartitionToFd(fd, partHeader, outFd);
+        if (map != NULL) {
+            char partitionName[256];
+            getPartitionName(partHeader, partitionName, sizeof(partitionName));
+            writeCsvField(map, partitionName);
+            fprintf(map, ",%llu,%u\n", (unsigned long long)position, partHeader->partitionSize);
+        }
+        position += partHeader->partitionSize;
+    }
+
+    uint64_t end = imageStart;
+    for (int i = 0; i < selectedCount && options.fillGaps; i++) {
+        // Overlapping partitions can make the last one not the furthest
+        uint64_t partEnd = imageStart + entries[i].header->partitionAddrInPac -
+                           entries[0].header->partitionAddrInPac + entries[i].header->partitionSize;
+        end = partEnd > end ? partEnd : end;
+    }
+    end = options.fillGaps ? end : position;
+    if (close(outFd) != 0 || (map != NULL && fclose(map) != 0)) {
+        logErrno("Error writing combined image");
+        exit(EXIT_FAILURE);
+    }
+    free(entries);
+
+    char sizeText[32];
+    formatSize(end - imageStart, sizeText, sizeof(sizeText));
+    logInfo("Combined %d partitions into %s, %llu bytes (%s)\n", selectedCount, options.combinePath,
+            (unsigned long long)(end - imageStart), sizeText);
+}
+
+// Returns how far into the file, from pacBase, the headers and partition
+// data of a PAC reach
+static uint64_t pacExtent(const PacHeader* pacHeader, PartitionHeader** partHeaders) {
+    uint64_t extent = pacHeader->partitionsListStart;
+    for (int i = 0; i < pacHeader->partitionCount; i++) {
+        extent += partHeaders[i]->length;
+    }
+    for (int i = 0; i < pacHeader->partitionCount; i++) {
+        uint64_t end = (uint64_t)partHeaders[i]->partitionAddrInPac + partHeaders[i]->partitionSize;
+        if (partHeaders[i]->partitionSize > 0 && end > extent) {
+            extent = end;
+        }
+    }
+    return extent;
+}
+
+// The format has no room for a high dword: someFields1 holds the file and
+// check flags in every PAC seen so far. A partition bigger than 4 GiB is
+// therefore stored with its size wrapped, which shows as 4 GiB or more of
+// unclaimed data between its declared end and whatever comes next.
+static void warnWrappedSizes(const PacHeader* pacHeader, PartitionHeader** partHeaders, off_t firmwareSize) {
+    for (int i = 0; i < pacHeader->partitionCount; i++) {
+        const PartitionHeader* partHeader = partHeaders[i];
+        if (partHeader->partitionSize == 0) {
+            continue;
+        }
+
+        uint64_t start = partHeader->partitionAddrInPac;
+        uint64_t next = firmwareSize > 0 ? (uint64_t)firmwareSize : 0;
+        for (int j = 0; j < pacHeader->partitionCount; j++) {
+            uint64_t other = partHeaders[j]->partitionAddrInPac;
+            if (partHeaders[j]->partitionSize > 0 && other > start && other < next) {
+                next = other;
+            }
+        }
+
+        uint64_t end = start + partHeader->partitionSize;
+        if (next >= end && next - end >= (uint64_t)UINT32_MAX + 1) {
+            char partitionName[256];
+            getString(partHeader->partitionName, ARRAY_LENGTH(partHeader->partitionName), partitionName,
+                      sizeof(partitionName));
+            logWarning("partition-size-wrapped", partitionName,
+                       "partition %s declares %u bytes but is followed by %llu unclaimed bytes, "
+                       "it may exceed 4 GiB and be truncated",
+                       partitionName, partHeader->partitionSize, (unsigned long long)(next - end));
+        }
+    }
+}
+
+// Checks that every selected, non-empty partition left an output file of
+// its size behind, or any file at all for one that went through a filter.
+// Returns how many didn't.
+static int verifyCompleteness(const char* outputPath, const PartitionStats* stats, int count) {
+    int expected = 0;
+    int missing = 0;
+    for (int i = 0; i < count; i++) {
+        if (stats[i].skipReason != NULL || stats[i].partitionSize == 0) {
+            continue;
+        }
+        expected++;
+
+        char outputFilePath[768];
+        snprintf(outputFilePath, sizeof(outputFilePath), "%s/%s", outputPath, stats[i].outputFileName);
+        struct stat outputStat;
+        if (stat(outputFilePath, &outputStat) == -1) {
+            logWarning("output-missing", stats[i].partitionName, "partition %s was declared but produced no file",
+                       stats[i].partitionName);
+            missing++;
+        } else if (S_ISREG(outputStat.st_mode) && !stats[i].filtered &&
+                   (uint64_t)outputStat.st_size != stats[i].bytes) {
+            logWarning("output-size-mismatch", stats[i].partitionName,
+                       "partition %s produced %lld bytes instead of %llu", stats[i].partitionName,
+                       (long long)outputStat.st_size, (unsigned long long)stats[i].bytes);
+            missing++;
+        }
+    }
+    logInfo("%d of %d expected partitions extracted completely\n", expected - missing, expected);
+    return missing;
+}
+
+// Lists, checks and extracts the PAC at pacBase. Returns how many bytes of
+// the file it spans, to find the next one in -multi mode.
+static uint64_t processPac(int fd, const struct stat* st, const char* outputPath, int extracting,
+                           double runStartTime) {
+    PacHeader pacHeader = readPacHeader(fd);
+    // The -summary-json counts are per PAC, as each PAC of a -multi dump gets
+    // its own document
+    int failedBefore = failedPartitionCount;
+    int mismatchesBefore = sumsFailed;
+
+    char firmwareName[256];
+    getString(pacHeader.firmwareName, ARRAY_LENGTH(pacHeader.firmwareName), firmwareName, sizeof(firmwareName));
+    logInfo("Firmware name: %s\n", firmwareName);
+
+    // A PAC in a -multi dump may be followed by others, so only the file
+    // size of the last one is known
+    uint64_t remaining = st->st_size - pacBase;
+    if (!options.ignoreMagic && (uint32_t)remaining != pacHeader.pacSize &&
+        (!options.multi || pacHeader.pacSize > remaining)) {
+        logWarning("pac-size-mismatch", NULL,
+                   "the PAC size field says %u bytes, but the file has %llu; this may not be a PAC "
+                   "(use -ignore-magic to silence this)", pacHeader.pacSize, (unsigned long long)remaining);
+    }
+
+    if (pacHeader.partitionCount < 0) {
+        logError("Invalid partition count %d in %s\n", pacHeader.partitionCount, options.firmwarePath);
+        close(fd);
+        exit(EXIT_FAILURE);
+    } else if (pacHeader.partitionCount == 0) {
+        if (options.strict) {
+            logError("No partitions found in PAC\n");
+            close(fd);
+            exit(EXIT_NO_PARTITIONS);
+        }
+        logInfo("No partitions found in PAC\n");
+    }
+
+    uint32_t curPos = pacHeader.partitionsListStart;
+    PartitionHeader** partHeaders = malloc(pacHeader.partitionCount * sizeof(PartitionHeader*));
+    headerIndices = malloc((pacHeader.partitionCount > 0 ? pacHeader.partitionCount : 1) * sizeof(int));
+    if ((partHeaders == NULL && pacHeader.partitionCount > 0) || headerIndices == NULL) {
+        logErrno("Memory allocation failed for partition headers");
+        close(fd);
+        exit(EXIT_FAILURE);
+    }
+
+    // A bad header is stepped over assuming it's as long as the one before,
+    // which it nearly always is
+    uint32_t lastLength = sizeof(PartitionHeader);
+    int headerCount = 0;
+    for (int i = 0; i < pacHeader.partitionCount; i++) {
+        PartitionHeader* partHeader = readPartitionHeader(fd, &curPos, st->st_size, lastLength);
+        if (partHeader == NULL) {
+            continue;
+        }
+        lastLength = partHeader->length;
+        partHeaders[headerCount] = partHeader;
+        headerIndices[headerCount] = i;
+        if (jsonlOutput != NULL) {
+            writePartitionJsonLine(jsonlOutput, i, partHeader);
+        }
+        headerCount++;
+    }
+    pacHeader.partitionCount = headerCount;
+    uint64_t extent = pacExtent(&pacHeader, partHeaders);
+    warnWrappedSizes(&pacHeader, partHeaders, st->st_size - pacBase);
+
+    if (options.typeNames != NULL) {
+        detectedTypes = malloc((pacHeader.partitionCount > 0 ? pacHeader.partitionCount : 1) * sizeof(char*));
+        if (detectedTypes == NULL) {
+            logErrno("Memory allocation failed");
+            exit(EXIT_FAILURE);
+        }
+        for (int i = 0; i < pacHeader.partitionCount; i++) {
+            const MagicSignature* sig = detectSignature(fd, partHeaders[i]);
+            detectedTypes[i] = sig != NULL ? sig->type : "unknown";
+        }
+    }
+    printPartitionList(partHeaders, pacHeader.partitionCount);
+    if (options.detect) {
+        printDetection(fd, partHeaders, pacHeader.partitionCount);
+    }
+    if (options.groupSlots) {
+        printSlotGroups(partHeaders, pacHeader.partitionCount);
+    }
+    if (options.listUnknownFields) {
+        printUnknownFields(partHeaders, pacHeader.partitionCount);
+    }
+
+    if (options.layoutPath != NULL) {
+        writeLayoutJson(options.layoutPath, &pacHeader, partHeaders);
+        logInfo("Saved layout to %s\n", options.layoutPath);
+    }
+    if (options.offsetsCsvPath != NULL) {
+        writeOffsetsCsv(options.offsetsCsvPath, &pacHeader, partHeaders);
+    }
+
+    if (options.interactive && extracting) {
+        selectPartitionsInteractively(partHeaders, pacHeader.partitionCount);
+    }
+
+    if (options.info) {
+        char version[256];
+        getFormatVersion(&pacHeader, version, sizeof(version));
+        logInfo("Format version: %s (%s%s)\n", version, isKnownFormatVersion(version) ? "known" : "unknown",
+                options.forceVersion != NULL ? ", forced" : "");
+        printSizeDiscrepancy(&pacHeader, partHeaders, st->st_size - pacBase);
+        if (options.checksumAlgorithms != 0) {
+            printFirmwareChecksums(fd, options.firmwarePath);
+        }
+    }
+
+    if (options.check || options.strict) {
+        int anomalies = runFormatChecks(&pacHeader, partHeaders);
+        if (options.check) {
+            reportAlignment(&pacHeader, partHeaders);
+            reportHeaderStride(&pacHeader, partHeaders);
+        }
+        logInfo("%d format anomalies found\n", anomalies);
+        if (anomalies > 0 && options.strict) {
+            logError("Refusing to continue with format anomalies in strict mode\n");
+            exit(EXIT_FAILURE);
+        }
+    }
+
+    if (options.fdTargetCount > 0) {
+        extractToFdTargets(fd, &pacHeader, partHeaders);
+    }
+    if (options.combinePath != NULL) {
+        writeCombinedImage(fd, &pacHeader, partHeaders);
+    }
+
+    if (!extracting) {
+        for (int i = 0; i < pacHeader.partitionCount; i++) {
+            free(partHeaders[i]);
+        }
+        free(partHeaders);
+        free(headerIndices);
+        headerIndices = NULL;
+        free(detectedTypes);
+        detectedTypes = NULL;
+        return extent;
+    }
+
+    // An absurd declared size usually means a corrupt header, which would
+    // otherwise read far past the end of the file or fill up the disk
+    for (int i = 0; i < pacHeader.partitionCount; i++) {
+        if (partHeaders[i]->partitionSize <= options.maxPartitionSize) {
+            continue;
+        }
+        char partitionName[256];
+        getPartitionName(partHeaders[i], partitionName, sizeof(partitionName));
+        if (options.strict) {
+            logError("Partition %s declares %u bytes, more than -max-partition-size\n",
+                     partitionName, partHeaders[i]->partitionSize);
+            exit(EXIT_FAILURE);
+        }
+        logWarning("partition-too-large", partitionName,
+                   "skipping partition %s, it declares %u bytes, more than -max-partition-size",
+                   partitionName, partHeaders[i]->partitionSize);
+    }
+
+    if (options.partialName != NULL) {
+        int found = 0;
+        for (int i = 0; i < pacHeader.partitionCount; i++) {
+            if (!partitionNameMatches(partHeaders[i], options.partialName)) {
+                continue;
+            }
+            found = 1;
+            if (options.partialOffset + options.partialLength > partHeaders[i]->partitionSize) {
+                logError("Slice %llu+%llu is outside the %u bytes of partition %s\n",
+                         (unsigned long long)options.partialOffset, (unsigned long long)options.partialLength,
+                         partHeaders[i]->partitionSize, options.partialName);
+                exit(EXIT_FAILURE);
+            }
+        }
+        if (!found) {
+            logError("No partition named %s\n", options.partialName);
+            exit(EXIT_FAILURE);
+        }
+    }
+
+    // Renamed files are fine, but an overwrite would lose a partition
+    int collisions = reportOutputNameCollisions(fd, partHeaders, pacHeader.partitionCount);
+    if (collisions > 0 && options.strict && !options.flatten && !options.lowercaseNames) {
+        logError("Refusing to overwrite extracted files in strict mode\n");
+        exit(EXIT_FAILURE);
+    }
+
+    PartitionStats* stats = calloc(pacHeader.partitionCount, sizeof(PartitionStats));
+    if (stats == NULL && pacHeader.partitionCount > 0) {
+        logErrno("Memory allocation failed for partition stats");
+        close(fd);
+        exit(EXIT_FAILURE);
+    }
+
+    // Peak memory is about 3 KiB per partition on top of the one copy
+    // buffer they all share. The whole partition table, about 1.5 KiB per
+    // header, is held from the start, since the listings, checks and name
+    // collision detection above need all of it. The PartitionStats entries,
+    // about 1.5 KiB each, are kept until the end for the reports. Each
+    // header is freed once its partition is done, which only lowers the
+    // tail.
+    char* buffer = malloc(options.bufferSize);
+    if (buffer == NULL) {
+        logErrno("Memory allocation failed");
+        exit(EXIT_FAILURE);
+    }
+    double startTime = monotonicSeconds();
+    uint64_t totalExtracted = 0;
+    for (int i = 0; i < pacHeader.partitionCount; i++) {
+        getPartitionName(partHeaders[i], stats[i].partitionName, sizeof(stats[i].partitionName));
+        getFileName(partHeaders[i], stats[i].fileName, sizeof(stats[i].fileName));
+        stats[i].skipReason = partitionSkipReason(i, partHeaders[i]);
+        if (stats[i].skipReason == NULL) {
+            double partitionStartTime = monotonicSeconds();
+            stats[i].bytes = extractPartition(fd, i, partHeaders[i], outputPath, st->st_size, buffer, &stats[i]);
+            stats[i].seconds = monotonicSeconds() - partitionStartTime;
+        } else if (warningsJson != NULL) {
+            // The listing already shows why on stdout, so this only goes to
+            // tools reading -warnings-json
+            logWarning("partition-skipped", stats[i].partitionName, "skipping partition %s: %s",
+                       stats[i].partitionName, stats[i].skipReason);
+        }
+        stats[i].partitionSize = partHeaders[i]->partitionSize;
+        stats[i].partitionAddrInPac = partHeaders[i]->partitionAddrInPac;
+        totalExtracted += stats[i].bytes;
+        free(partHeaders[i]);
+    }
+    free(buffer);
+
+    if (options.fsync) {
+        syncOutputDirectories(outputPath, stats, pacHeader.partitionCount);
+    }
+    if (options.verifyComplete && verifyCompleteness(outputPath, stats, pacHeader.partitionCount) > 0 &&
+        options.strict) {
+        logError("Extraction is incomplete, failing in strict mode\n");
+        exit(EXIT_FAILURE);
+    }
+
+    if (options.bench) {
+        double elapsed = monotonicSeconds() - startTime;
+        logResult("Extracted %llu bytes in %.3f s (%.1f MiB/s)\n", (unsigned long long)totalExtracted, elapsed,
+                  bytesPerSecond(totalExtracted, elapsed) / (1024 * 1024));
+    }
+    if (options.statsJsonPath != NULL) {
+        writeStatsJson(options.statsJsonPath, stats, pacHeader.partitionCount, monotonicSeconds() - runStartTime);
+    }
+    if (options.summaryJsonPath != NULL) {
+        writeSummaryJson(options.summaryJsonPath, firmwareName, outputPath, stats, pacHeader.partitionCount,
+                         failedPartitionCount - failedBefore, sumsFailed - mismatchesBefore,
+                         monotonicSeconds() - runStartTime);
+    }
+    free(stats);
+    freeUsedOutputNames();
+    free(interactiveSelection);
+    interactiveSelection = NULL;
+    free(detectedTypes);
+    detectedTypes = NULL;
+    free(headerIndices);
+    headerIndices = NULL;
+    free(partHeaders);
+    return extent;
+}
+
+// Observed values of one unknown header field for -report
+typedef struct {
+    char name[64];
+    long samples;
+    int64_t first;
+    int64_t min;
+    int64_t max;
+    int constant;
+} FieldValues;
+
+static void addFieldValue(FieldValues* field, int64_t value) {
+    if (field->samples == 0) {
+        field->first = field->min = field->max = value;
+        field->constant = 1;
+    }
+    field->constant = field->constant && value == field->first;
+    field->min = value < field->min ? value : field->min;
+    field->max = value > field->max ? value : field->max;
+    field->samples++;
+}
+
+static void nameFieldValues(FieldValues* fields, const char* prefix, int count) {
+    for (int i = 0; i < count; i++) {
+        snprintf(fields[i].name, sizeof(fields[i].name), "%s[%d]", prefix, i);
+    }
+}
+
+// Collects the values of every field whose meaning is unknown across a set
+// of PACs. A field that never changes is likely a magic or version number,
+// one that does a count, size or offset.
+static int runFieldReport(int count, char** paths) {
+    FieldValues fields[5 + 6 + 2 + 2 + 3] = { 0 };
+    FieldValues* pacFields1 = &fields[0];
+    FieldValues* pacFields2 = &fields[5];
+    FieldValues* pacFields3 = &fields[11];
+    FieldValues* partFields1 = &fields[13];
+    FieldValues* partFields2 = &fields[15];
+    nameFieldValues(pacFields1, "PacHeader.someIntFields1", 5);
+    nameFieldValues(pacFields2, "PacHeader.someIntFields2", 6);
+    nameFieldValues(pacFields3, "PacHeader.someIntFields3", 2);
+    nameFieldValues(partFields1, "PartitionHeader.someFields1", 2);
+    nameFieldValues(partFields2, "PartitionHeader.someFields2", 3);
+
+    // Keep going past damaged files and headers, a report over the rest
+    // is still useful
+    options.skipBadHeaders = 1;
+    int pacCount = 0;
+    for (int f = 0; f < count; f++) {
+        int fd = openFirmwareFile(paths[f]);
+        struct stat st;
+        if (fstat(fd, &st) == -1) {
+            logErrno(paths[f]);
+            exit(EXIT_FAILURE);
+        }
+        const char* reason = "smaller than a PAC header";
+        PacHeader pacHeader;
+        if (st.st_size >= (off_t)sizeof(PacHeader)) {
+            pacHeader = readPacHeader(fd);
+            reason = validatePacHeader(&pacHeader, st.st_size);
+        }
+        if (reason != NULL) {
+            logWarning("not-a-pac", NULL, "skipping %s, it doesn't look like a PAC: %s", paths[f], reason);
+            close(fd);
+            continue;
+        }
+
+        pacCount++;
+        for (int i = 0; i < 5; i++) {
+            addFieldValue(&pacFields1[i], pacHeader.someIntFields1[i]);
+        }
+        for (int i = 0; i < 6; i++) {
+            addFieldValue(&pacFields2[i], pacHeader.someIntFields2[i]);
+        }
+        for (int i = 0; i < 2; i++) {
+            addFieldValue(&pacFields3[i], pacHeader.someIntFields3[i]);
+        }
+
+        uint32_t curPos = pacHeader.partitionsListStart;
+        for (int p = 0; p < pacHeader.partitionCount; p++) {
+            PartitionHeader* partHeader = readPartitionHeader(fd, &curPos, st.st_size, 0);
+            if (partHeader == NULL) {
+                break;
+            }
+            for (int i = 0; i < 2; i++) {
+                addFieldValue(&partFields1[i], partHeader->someFields1[i]);
+            }
+            for (int i = 0; i < 3; i++) {
+                addFieldValue(&partFields2[i], partHeader->someFields2[i]);
+            }
+            free(partHeader);
+        }
+        close(fd);
+    }
+
+    printf("%d PAC files\n", pacCount);
+    printf("%-32s %8s  %-8s  %s\n", "Field", "Samples", "Values", "Observed");
+    for (size_t i = 0; i < ARRAY_LENGTH(fields); i++) {
+        const FieldValues* field = &fields[i];
+        if (field->samples == 0) {
+            printf("%-32s %8ld  %-8s\n", field->name, field->samples, "-");
+        } else if (field->constant) {
+            printf("%-32s %8ld  %-8s  %lld (0x%llx)\n", field->name, field->samples, "constant",
+                   (long long)field->first, (unsigned long long)(uint32_t)field->first);
+        } else {
+            printf("%-32s %8ld  %-8s  %lld..%lld\n", field->name, field->samples, "variable",
+                   (long long)field->min, (long long)field->max);
+        }
+    }
+    return pacCount > 0 ? EXIT_SUCCESS : EXIT_FAILURE;
+}
+
+// Stores ASCII text as the UTF-16 used by the header name fields
+static void encodeUtf16(int16_t* dest, size_t length, const char* text) {
+    memset(dest, 0, length * sizeof(int16_t));
+    for (size_t i = 0; i + 1 < length && text[i]; i++) {
+        dest[i] = (unsigned char)text[i];
+    }
+}
+
+// Byte i of a self-test partition's data
+static unsigned char selfTestByte(int partition, uint32_t i) {
+    return (unsigned char)(i * 31 + partition * 7 + (i >> 8));
+}
+
+// Writes a small PAC to a temporary directory, extracts it with the normal
+// code path and compares the output byte for byte. Returns the exit status.
+static int runSelfTest(void) {
+    static const struct {
+        const char* partitionName;
+        const char* fileName;
+        uint32_t size;
+    } parts[] = {
+        { "FDL", "fdl1.bin", 1000 },
+        { "boot", "boot.img", 70000 },
+        { "empty", "empty.bin", 0 },
+        { "system", "system.img", DEFAULT_BUFFER_SIZE + 12345 },
+    };
+    const int count = ARRAY_LENGTH(parts);
+
+    const char* tmp = getenv("TMPDIR");
+    char directory[512];
+    snprintf(directory, sizeof(directory), "%s/pacextractor-selftest-XXXXXX", tmp != NULL ? tmp : "/tmp");
+    if (mkdtemp(directory) == NULL) {
+        logErrno("Error creating self-test directory");
+        return EXIT_FAILURE;
+    }
+    char pacPath[768];
+    char outputPath[768];
+    snprintf(pacPath, sizeof(pacPath), "%s/selftest.pac", directory);
+    snprintf(outputPath, sizeof(outputPath), "%s/out", directory);
+
+    PacHeader pacHeader = { 0 };
+    encodeUtf16(pacHeader.version, ARRAY_LENGTH(pacHeader.version), knownFormatVersions[0]);
+    encodeUtf16(pacHeader.productName, ARRAY_LENGTH(pacHeader.productName), "SelfTest");
+    encodeUtf16(pacHeader.firmwareName, ARRAY_LENGTH(pacHeader.firmwareName), "SelfTest");
+    pacHeader.partitionCount = count;
+    pacHeader.partitionsListStart = sizeof(PacHeader);
+
+    PartitionHeader partHeaders[ARRAY_LENGTH(parts)];
+    uint32_t dataOffset = sizeof(PacHeader) + count * sizeof(PartitionHeader);
+    for (int i = 0; i < count; i++) {
+        memset(&partHeaders[i], 0, sizeof(PartitionHeader));
+        partHeaders[i].length = sizeof(PartitionHeader);
+        encodeUtf16(partHeaders[i].partitionName, ARRAY_LENGTH(partHeaders[i].partitionName),
+                    parts[i].partitionName);
+        encodeUtf16(partHeaders[i].fileName, ARRAY_LENGTH(partHeaders[i].fileName), parts[i].fileName);
+        partHeaders[i].partitionSize = parts[i].size;
+        partHeaders[i].partitionAddrInPac = parts[i].size > 0 ? dataOffset : 0;
+        dataOffset += parts[i].size;
+    }
+    pacHeader.pacSize = dataOffset;
+
+    FILE* pac = fopen(pacPath, "wb");
+    if (pac == NULL) {
+        logErrno("Error creating self-test PAC");
+        return EXIT_FAILURE;
+    }
+    fwrite(&pacHeader, sizeof(pacHeader), 1, pac);
+    fwrite(partHeaders, sizeof(PartitionHeader), count, pac);
+    for (int i = 0; i < count; i++) {
+        for (uint32_t j = 0; j < parts[i].size; j++) {
+            fputc(selfTestByte(i, j), pac);
+        }
+    }
+    if (fclose(pac) != 0) {
+        logErrno("Error writing self-test PAC");
+        return EXIT_FAILURE;
+    }
+
+    options.firmwarePath = pacPath;
+    options.outputPath = outputPath;
+    options.quiet = 1;
+    int fd = openFirmwareFile(pacPath);
+    struct stat st;
+    if (fstat(fd, &st) == -1) {
+        logErrno("Error getting file stats");
+        return EXIT_FAILURE;
+    }
+    createOutputDirectory(outputPath);
+    processPac(fd, &st, outputPath, 1, monotonicSeconds());
+    close(fd);
+
+    int failures = 0;
+    for (int i = 0; i < count; i++) {
+        char filePath[1024];
+        snprintf(filePath, sizeof(filePath), "%s/%s", outputPath, parts[i].fileName);
+        FILE* file = fopen(filePath, "rb");
+        if (file == NULL) {
+            // Empty partitions have no data to extract
+            if (parts[i].size > 0) {
+                printf("FAIL: %s was not extracted\n", parts[i].fileName);
+                failures++;
+            }
+            continue;
+        }
+        uint32_t length = 0;
+        int c;
+        int mismatch = 0;
+        while ((c = fgetc(file)) != EOF) {
+            if (length >= parts[i].size || c != selfTestByte(i, length)) {
+                mismatch = 1;
+                break;
+            }
+            length++;
+        }
+        fclose(file);
+        if (mismatch || length != parts[i].size) {
+            printf("FAIL: %s differs from the data in the PAC\n", parts[i].fileName);
+            failures++;
+        }
+        remove(filePath);
+    }
+    rmdir(outputPath);
+    remove(pacPath);
+    rmdir(directory);
+
+    printf("Self-test %s\n", failures == 0 ? "PASS" : "FAIL");
+    return failures == 0 ? EXIT_SUCCESS : EXIT_FAILURE;
+}
+
+static void writeShellWord(FILE* file, const char* text) {
+    fputs(" '", file);
+    for (; *text; text++) {
+        if (*text == '\'') {
+            fputs("'\\''", file);
+        } else {
+            fputc(*text, file);
+        }
+    }
+    fputc('\'', file);
+}
+
+static void writeShellSizeOption(FILE* file, const char* name, uint64_t value) {
+    char text[32];
+    snprintf(text, sizeof(text), "%llu", (unsigned long long)value);
+    writeShellWord(file, name);
+    writeShellWord(file, text);
+}
+
+// Options -emit-script writes with their resolved values instead, or not at
+// all
+static const char* const resolvedScriptOptions[] = {
+    "-e", "-o", "-emit-script", "-buffer-size", "-write-buffer", "-min-size", "-max-size", "-max-partition-size",
+};
+
+static int isRecordedBefore(int index) {
+    const RecordedOption* option = &recordedOptions[index];
+    for (int i = 0; i < index; i++) {
+        const RecordedOption* other = &recordedOptions[i];
+        int same = other->count == option->count;
+        for (int w = 0; same && w < option->count; w++) {
+            same = strcmp(other->words[w], option->words[w]) == 0;
+        }
+        if (same) {
+            return 1;
+        }
+    }
+    return 0;
+}
+
+// Writes the -emit-script script. It runs from this working directory, so
+// relative paths still work, and with -no-config, so that the rerunner's
+// config file and environment don't change anything. Instead, the config
+// file settings and then the command line options are written out once
+// each, followed by the resolved paths, buffer sizes and size filters.
+static void writeExtractionScript(const char* path, char* program) {
+    FILE* file = fopen(path, "w");
+    if (file == NULL) {
+        logErrno("Error creating script");
+        exit(EXIT_FAILURE);
+    }
+
+    char* workingDirectory = getcwd(NULL, 0);
+    if (workingDirectory == NULL) {
+        logErrno("Error getting the working directory");
+        exit(EXIT_FAILURE);
+    }
+    fprintf(file, "#!/bin/sh\n# Reruns an extraction done with pacextractor %s\ncd", VERSION);
+    writeShellWord(file, workingDirectory);
+    free(workingDirectory);
+    fprintf(file, " || exit 1\nexec");
+    writeShellWord(file, program);
+    writeShellWord(file, "-no-config");
+    for (int i = 0; i < recordedOptionCount; i++) {
+        int resolved = 0;
+        for (size_t r = 0; r < ARRAY_LENGTH(resolvedScriptOptions); r++) {
+            resolved |= strcmp(recordedOptions[i].words[0], resolvedScriptOptions[r]) == 0;
+        }
+        if (resolved || isRecordedBefore(i)) {
+            continue;
+        }
+        for (int w = 0; w < recordedOptions[i].count; w++) {
+            writeShellWord(file, recordedOptions[i].words[w]);
+        }
+    }
+    writeShellWord(file, "-e");
+    writeShellWord(file, options.firmwarePath);
+    if (options.outputPath != NULL) {
+        writeShellWord(file, "-o");
+        writeShellWord(file, options.outputPath);
+    }
+    writeShellSizeOption(file, "-buffer-size", options.bufferSize);
+    writeShellSizeOption(file, "-write-buffer", options.writeBufferSize);
+    if (options.minSize > 0) {
+        writeShellSizeOption(file, "-min-size", options.minSize);
+    }
+    if (options.maxSize != UINT64_MAX) {
+        writeShellSizeOption(file, "-max-size", options.maxSize);
+    }
+    if (options.maxPartitionSize != UINT64_MAX) {
+        writeShellSizeOption(file, "-max-partition-size", options.maxPartitionSize);
+    }
+    fputc('\n', file);
+
+    if (fclose(file) != 0 || chmod(path, 0755) != 0) {
+        logErrno("Error writing script");
+        exit(EXIT_FAILURE);
+    }
+}
+
+int main(int argc, char** argv) {
+    // These run with the built-in defaults only, not the environment or config
+    if (argc == 2 && strcmp(argv[1], "-selftest") == 0) {
+        return runSelfTest();
+    }
+    if (argc >= 3 && strcmp(argv[1], "-report") == 0) {
+        return runFieldReport(argc - 2, argv + 2);
+    }
+
+    // Lowest precedence first: environment, config file, command line.
+    // -no-config leaves out the first two.
+    int noConfig = 0;
+    for (int i = 1; i < argc; i++) {
+        noConfig |= strcmp(argv[i], "-no-config") == 0;
+    }
+    if (!noConfig) {
+        options.outputPath = getenv(OUTPUT_ENV_VAR);
+        loadConfigFile();
+    }
+
+    for (int i = 1; i < argc; i++) {
+        if (strcmp(argv[i], "-no-config") == 0) {
+            continue;
+        } else if (strcmp(argv[i], "-h") == 0) {
+            printUsage();
+            exit(EXIT_SUCCESS);
+        } else if (strcmp(argv[i], "-v") == 0) {
+            printf("pacextractor version %s\n", VERSION);
+            exit(EXIT_SUCCESS);
+        } else if (strcmp(argv[i], "-layout") == 0) {
+            printHeaderLayout();
+            exit(EXIT_SUCCESS);
+        }
+
+        int consumed = parseOption(argc, argv, i);
+        if (consumed == 0) {
+            printUsageAndExit();
+        }
+        recordOption(argv + i, consumed);
+        i += consumed - 1;
+    }
+
+    int extracting = !options.info && !options.check && !options.isPac && !options.count && !options.listSizes &&
+                     !options.probe && options.fdTargetCount == 0 && options.stdoutPartition == NULL &&
+                     options.combinePath == NULL && options.carvePath == NULL;
+    if (options.firmwarePath == NULL || (options.outputPath == NULL && extracting)) {
+        printUsageAndExit();
+    }
+    if (options.progressFd != -1) {
+        int flags = fcntl(options.progressFd, F_GETFL);
+        if (flags == -1 || (flags & O_ACCMODE) == O_RDONLY) {
+            logError("File descriptor %d for -progress-fd is not open for writing\n", options.progressFd);
+            exit(EXIT_FAILURE);
+        }
+    }
+    if (options.stdoutPartition != NULL && (options.jsonl || options.fdTargetCount == MAX_FD_TARGETS)) {
+        logError("-stdout-partition cannot be combined with -jsonl or %d -extract-to-fd targets\n",
+                 MAX_FD_TARGETS);
+        exit(EXIT_FAILURE);
+    }
+
+    if (options.warningsJsonTarget != NULL) {
+        // All digits means an inherited file descriptor, like -progress-fd
+        const char* target = options.warningsJsonTarget;
+        if (strspn(target, "0123456789") == strlen(target)) {
+            int warningsFd = dup(atoi(target));
+            warningsJson = warningsFd != -1 ? fdopen(warningsFd, "w") : NULL;
+        } else {
+            warningsJson = fopen(target, "w");
+        }
+        if (warningsJson == NULL) {
+            logErrno("Error opening -warnings-json output");
+            exit(EXIT_FAILURE);
+        }
+    }
+
+    if (options.logFilePath != NULL) {
+        logFile = fopen(options.logFilePath, "a");
+        if (logFile == NULL) {
+            logErrno("Error opening log file");
+            exit(EXIT_FAILURE);
+        }
+        logToFile("pacextractor %s started\n", VERSION);
+    }
+
+    if (options.scriptPath != NULL) {
+        writeExtractionScript(options.scriptPath, argv[0]);
+        logToFile("Wrote extraction script to %s\n", options.scriptPath);
+    }
+
+    if (options.sincePath != NULL) {
+        loadSinceManifest(options.sincePath);
+    }
+    if (options.expectSumsPath != NULL) {
+        loadExpectedSums(options.expectSumsPath);
+    }
+    if (options.aliasPath != NULL) {
+        loadNameAliases(options.aliasPath);
+    }
+
+    if (options.jsonl) {
+        // Keep the real stdout for the records and point file descriptor 1,
+        // which every other printf ends up on, at stderr
+        fflush(stdout);
+        int jsonlFd = dup(STDOUT_FILENO);
+        if (jsonlFd == -1 || (jsonlOutput = fdopen(jsonlFd, "w")) == NULL ||
+            dup2(STDERR_FILENO, STDOUT_FILENO) == -1) {
+            logErrno("Error setting up -jsonl output");
+            exit(EXIT_FAILURE);
+        }
+    }
+    if (options.stdoutPartition != NULL) {
+        // Same trick as -jsonl: the partition gets the real stdout, and every
+        // message goes to stderr
+        fflush(stdout);
+        stdoutPartitionFd = dup(STDOUT_FILENO);
+        if (stdoutPartitionFd == -1 || dup2(STDERR_FILENO, STDOUT_FILENO) == -1) {
+            logErrno("Error setting up -stdout-partition output");
+            exit(EXIT_FAILURE);
+        }
+        FdTarget* target = &options.fdTargets[options.fdTargetCount++];
+        snprintf(target->partitionName, sizeof(target->partitionName), "%s", options.stdoutPartition);
+        target->fd = stdoutPartitionFd;
+    }
+
+    double runStartTime = monotonicSeconds();
+
+    // Only a hint at a wrong file; the header checks decide what gets parsed
+    size_t pathLength = strlen(options.firmwarePath);
+    if (!options.noExtCheck && (pathLength < 4 || strcasecmp(options.firmwarePath + pathLength - 4, ".pac") != 0)) {
+        logWarning("file-extension", NULL,
+                   "%s doesn't have a .pac extension, is it the right file? (use -no-ext-check to silence this)",
+                   options.firmwarePath);
+    }
+
+    // Process the extraction
+    int fd = openFirmwareFile(options.firmwarePath);
+    if (options.direct) {
+        openDirectInput(options.firmwarePath);
+    }
+
+    struct stat st;
+    if (fstat(fd, &st) == -1) {
+        logErrno("Error getting file stats");
+        exit(EXIT_FAILURE);
+    }
+
+    if (options.isPac) {
+        const char* reason = "smaller than a PAC header";
+        if (st.st_size >= (off_t)sizeof(PacHeader)) {
+            PacHeader header = readPacHeader(fd);
+            reason = validatePacHeader(&header, st.st_size);
+        }
+        printf("%s\n", reason == NULL ? "true" : "false");
+        close(fd);
+        exit(reason == NULL ? EXIT_SUCCESS : EXIT_FAILURE);
+    }
+
+    // Only the PAC header is needed for the count, but it must be sane for
+    // the count to mean anything
+    if (options.count) {
+        if (st.st_size < (off_t)sizeof(PacHeader)) {
+            logError("File %s is not a valid firmware\n", options.firmwarePath);
+            exit(EXIT_FAILURE);
+        }
+        PacHeader header = readPacHeader(fd);
+        const char* reason = validatePacHeader(&header, st.st_size);
+        if (reason != NULL) {
+            logError("File %s is not a valid firmware: %s\n", options.firmwarePath, reason);
+            exit(EXIT_FAILURE);
+        }
+        printf("%d\n", header.partitionCount);
+        close(fd);
+        exit(EXIT_SUCCESS);
+    }
+
+    if (options.probe) {
+        if (st.st_size < (off_t)sizeof(PacHeader)) {
+            logError("File %s is not a valid firmware\n", options.firmwarePath);
+            exit(EXIT_FAILURE);
+        }
+        probeLayouts(fd, st.st_size);
+        close(fd);
+        exit(EXIT_SUCCESS);
+    }
+
+    // Nothing but the sizes may be printed, so this doesn't go through
+    // processPac and its listing
+    if (options.listSizes) {
+        if (st.st_size < (off_t)sizeof(PacHeader)) {
+            logError("File %s is not a valid firmware\n", options.firmwarePath);
+            exit(EXIT_FAILURE);
+        }
+        PacHeader header = readPacHeader(fd);
+        uint32_t curPos = header.partitionsListStart;
+        for (int i = 0; i < header.partitionCount; i++) {
+            PartitionHeader* partHeader = readPartitionHeader(fd, &curPos, st.st_size, 0);
+            if (partHeader == NULL) {
+                break;
+            }
+            char partitionName[256];
+            char sizeText[32];
+            getPartitionName(partHeader, partitionName, sizeof(partitionName));
+            if (options.human) {
+                formatSize(partHeader->partitionSize, sizeText, sizeof(sizeText));
+            } else {
+                snprintf(sizeText, sizeof(sizeText), "%u", partHeader->partitionSize);
+            }
+            printf("%s\t%s\n", partitionName, sizeText);
+            free(partHeader);
+        }
+        close(fd);
+        exit(EXIT_SUCCESS);
+    }
+
+    // A carved range ignores the PAC structure, so the file need not even
+    // be a PAC
+    if (options.carvePath != NULL) {
+        if (options.carveOffset > (uint64_t)st.st_size || options.carveLength > st.st_size - options.carveOffset) {
+            logError("Range %llu:%llu is outside the %lld byte file\n", (unsigned long long)options.carveOffset,
+                     (unsigned long long)options.carveLength, (long long)st.st_size);
+            exit(EXIT_FAILURE);
+        }
+        int outFd = open(options.carvePath, O_WRONLY | O_CREAT | O_TRUNC, 0644);
+        if (outFd == -1) {
+            logErrno("Error creating carve output file");
+            exit(EXIT_FAILURE);
+        }
+        copyRangeToFd(fd, options.carveOffset, options.carveLength, outFd);
+        if (close(outFd) != 0) {
+            logErrno("Error writing carve output file");
+            exit(EXIT_FAILURE);
+        }
+        logInfo("Wrote %llu bytes from offset %llu to %s\n", (unsigned long long)options.carveLength,
+                (unsigned long long)options.carveOffset, options.carvePath);
+        close(fd);
+        exit(EXIT_SUCCESS);
+    }
+
+    int firmwareSize = st.st_size;
+    if (firmwareSize < sizeof(PacHeader)) {
+        logError("File %s is not a valid firmware\n", options.firmwarePath);
+        close(fd);
+        exit(EXIT_FAILURE);
+    }
+
+    if (extracting) {
+        createOutputDirectory(options.outputPath);
+        checkOutputWritable(options.outputPath);
+    }
+
+    // Later PACs of a -multi dump start right where the previous one ends
+    for (int pacIndex = 0;; pacIndex++) {
+        char pacOutputPath[768];
+        const char* outputPath = options.outputPath;
+        if (options.multi) {
+            logInfo("PAC %d at offset %lld\n", pacIndex, (long long)pacBase);
+            if (extracting) {
+                snprintf(pacOutputPath, sizeof(pacOutputPath), "%s/pac%d", options.outputPath, pacIndex);
+                createOutputDirectory(pacOutputPath);
+                outputPath = pacOutputPath;
+            }
+        }
+
+        uint64_t extent = processPac(fd, &st, outputPath, extracting, runStartTime);
+        if (!options.multi || extent == 0 || pacBase + extent + sizeof(PacHeader) > (uint64_t)st.st_size) {
+            break;
+        }
+        off_t nextBase = pacBase + extent;
+        PacHeader next;
+        if (pread(fd, &next, sizeof(next), nextBase) != sizeof(next) ||
+            validatePacHeader(&next, st.st_size - nextBase) != NULL) {
+            break;
+        }
+        pacBase = nextBase;
+    }
+
+    int sumsOk = !extracting || options.expectSumsPath == NULL || reportExpectedSums();
+    free(expectedSums);
+    free(sinceManifest);
+    free(nameAliases);
+    if (jsonlOutput != NULL) {
+        fclose(jsonlOutput);
+    }
+    verifyFirmwareUnchanged(fd, &st);
+    close(fd);
+    if (directFd != -1) {
+        close(directFd);
+        free(directBuffer);
+    }
+
+    if (failedPartitionCount > 0) {
+        logError("%d partitions failed\n", failedPartitionCount);
+        return EXIT_FAILURE;
+    }
+    return sumsOk ? EXIT_SUCCESS : EXIT_FAILURE;
 }